@@ -2,64 +2,254 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"github.com/chzyer/readline"
 	"github.com/spf13/cobra"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	reconnectInitialDelay = 100 * time.Millisecond
+	reconnectMaxDelay     = 5 * time.Second
+	reconnectMaxAttempts  = 10
 )
 
 type MedisClient struct {
-	conn net.Conn
+	conn    net.Conn
+	reader  *bufio.Reader
+	network string
+	addr    string
+
+	// reconnect makes runCommand redial and retry once when the
+	// connection fails.
+	reconnect bool
+	// verbose prints the raw bytes of every request and reply to stderr.
+	verbose bool
+
+	// connectTimeout bounds each dial and commandTimeout each round trip;
+	// 0 means wait indefinitely.
+	connectTimeout time.Duration
+	commandTimeout time.Duration
 }
 
-func NewMedisClient(addr string) (*MedisClient, error) {
-	conn, err := net.Dial("tcp", addr)
+func NewMedisClient(network, addr string, connectTimeout time.Duration) (*MedisClient, error) {
+	conn, err := net.DialTimeout(network, addr, connectTimeout)
 	if err != nil {
 		return nil, err
 	}
-	return &MedisClient{conn: conn}, nil
+	return &MedisClient{conn: conn, reader: bufio.NewReader(conn), network: network, addr: addr, reconnect: true, connectTimeout: connectTimeout}, nil
+}
+
+func (client *MedisClient) Close() error {
+	return client.conn.Close()
 }
 
 func (client *MedisClient) runCommand(cmd string) (string, error) {
-	_, err := client.conn.Write([]byte(cmd + "\r\n"))
-	if err != nil {
+	resp, err := client.roundTrip(cmd)
+	// A successful SHUTDOWN closes the connection without replying. It's
+	// never retried, since that could stop a server restarted meanwhile.
+	if fields := strings.Fields(cmd); len(fields) > 0 && strings.EqualFold(fields[0], "SHUTDOWN") {
+		if errors.Is(err, io.EOF) {
+			return "", nil
+		}
+		return resp, err
+	}
+	// A reply that timed out may still arrive, so retrying on the same
+	// stream could read it as the retry's reply.
+	if err == nil || !client.reconnect || errors.Is(err, os.ErrDeadlineExceeded) {
+		return resp, err
+	}
+	if err := client.redial(); err != nil {
 		return "", err
 	}
-	resp := make([]byte, 1024)
-	n, err := client.conn.Read(resp)
+	return client.roundTrip(cmd)
+}
+
+// redial replaces the connection, backing off exponentially between
+// attempts until it succeeds or reconnectMaxAttempts is reached.
+func (client *MedisClient) redial() error {
+	_ = client.conn.Close()
+	delay := reconnectInitialDelay
+	var err error
+	for attempt := 1; attempt <= reconnectMaxAttempts; attempt++ {
+		_, _ = fmt.Fprintf(os.Stderr, "Connection lost, reconnecting in %s (attempt %d/%d)\n", delay, attempt, reconnectMaxAttempts)
+		time.Sleep(delay)
+		var conn net.Conn
+		if conn, err = net.DialTimeout(client.network, client.addr, client.connectTimeout); err == nil {
+			client.conn = conn
+			client.reader = bufio.NewReader(conn)
+			return nil
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+	return fmt.Errorf("could not reconnect to %s: %w", client.addr, err)
+}
+
+func (client *MedisClient) roundTrip(cmd string) (string, error) {
+	req := cmd + "\r\n"
+	if client.verbose {
+		_, _ = fmt.Fprintf(os.Stderr, "-> %s\n", strconv.Quote(req))
+	}
+	var deadline time.Time
+	if client.commandTimeout > 0 {
+		deadline = time.Now().Add(client.commandTimeout)
+	}
+	if err := client.conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	_, err := client.conn.Write([]byte(req))
+	if err != nil {
+		return "", client.timeoutError(err)
+	}
+	resp, err := client.readReply()
+	if err != nil {
+		return "", client.timeoutError(err)
+	}
+	if client.verbose {
+		_, _ = fmt.Fprintf(os.Stderr, "<- %s\n", strconv.Quote(resp))
+	}
+	return resp, nil
+}
+
+// readReply reads one whole reply. Every reply is a single line except
+// arrays, whose "*<count>" line is followed by that many replies, which may
+// be arrays themselves.
+func (client *MedisClient) readReply() (string, error) {
+	line, err := client.reader.ReadString('\n')
 	if err != nil {
 		return "", err
 	}
-	return string(resp[:n]), nil
+	if line[0] != '*' {
+		return line, nil
+	}
+	n, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil {
+		return line, nil
+	}
+	var b strings.Builder
+	b.WriteString(line)
+	for i := 0; i < n; i++ {
+		item, err := client.readReply()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(item)
+	}
+	return b.String(), nil
+}
+
+// runFile sends each non-empty line of the file at path as a command,
+// reporting error replies with their line numbers on stderr. It fails if
+// any command did.
+func (client *MedisClient) runFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		resp, err := client.runCommand(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		// Errors start with an uppercase code, as in "-ERR", unlike
+		// negative integer replies such as TTL's "-2".
+		if len(resp) > 1 && resp[0] == '-' && resp[1] >= 'A' && resp[1] <= 'Z' {
+			_, _ = fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, i+1, strings.TrimSuffix(resp, "\n"))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d commands in %s failed", failed, path)
+	}
+	return nil
+}
+
+// timeoutError explains err if it's the command deadline expiring.
+func (client *MedisClient) timeoutError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("no reply from %s within %s: %w", client.addr, client.commandTimeout, err)
+	}
+	return err
 }
 
 func main() {
 	fmt.Println("client")
 
-	var host, port string
+	var host, port, socket string
+	var noReconnect, verbose bool
+	var connectTimeout, commandTimeout time.Duration
+	var file string
 
 	var rootCmd = &cobra.Command{
 		Use:   "medis-cli",
 		Short: "A simple CLI for MiniRedis",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			addr := net.JoinHostPort(host, port)
-			client, err := NewMedisClient(addr)
+			// JoinHostPort adds the brackets an IPv6 host needs, so accept
+			// the host with or without them.
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			network, addr := "tcp", net.JoinHostPort(host, port)
+			if socket != "" {
+				network, addr = "unix", socket
+			}
+			client, err := NewMedisClient(network, addr, connectTimeout)
+			if err != nil {
+				return err
+			}
+			client.reconnect = !noReconnect
+			client.verbose = verbose
+			client.commandTimeout = commandTimeout
+			defer func(client *MedisClient) {
+				_ = client.Close()
+			}(client)
+			// From here on errors come from the server, not from misuse.
+			cmd.SilenceUsage = true
+
+			if file != "" {
+				return client.runFile(file)
+			}
+
+			historyFile := ""
+			if home, err := os.UserHomeDir(); err == nil {
+				historyFile = filepath.Join(home, ".medis_history")
+			}
+			rl, err := readline.NewEx(&readline.Config{
+				Prompt:      "medis> ",
+				HistoryFile: historyFile,
+			})
 			if err != nil {
 				return err
 			}
-			defer func(conn net.Conn) {
-				_ = conn.Close()
-			}(client.conn)
+			defer func(rl *readline.Instance) {
+				_ = rl.Close()
+			}(rl)
 
 			for {
-				fmt.Print("medis> ")
-				reader := bufio.NewReader(os.Stdin)
-				cmdString, err := reader.ReadString('\n')
+				cmdString, err := rl.Readline()
+				if errors.Is(err, readline.ErrInterrupt) {
+					continue
+				}
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
 				if err != nil {
 					return err
 				}
 				cmdString = strings.TrimSpace(cmdString)
+				if cmdString == "" {
+					continue
+				}
 				if cmdString == "exit" || cmdString == "quit" {
 					return nil
 				}
@@ -74,6 +264,12 @@ func main() {
 
 	rootCmd.PersistentFlags().StringVarP(&host, "host", "H", "localhost", "Server host")
 	rootCmd.PersistentFlags().StringVarP(&port, "port", "P", "6379", "Server port")
+	rootCmd.PersistentFlags().StringVarP(&socket, "socket", "s", "", "Server Unix socket path, overrides host and port")
+	rootCmd.PersistentFlags().BoolVar(&noReconnect, "no-reconnect", false, "Exit instead of reconnecting when the connection drops")
+	rootCmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", 0, "Give up connecting after this long, 0 to wait indefinitely")
+	rootCmd.PersistentFlags().DurationVar(&commandTimeout, "command-timeout", 0, "Give up waiting for a reply after this long, 0 to wait indefinitely")
+	rootCmd.PersistentFlags().StringVarP(&file, "file", "f", "", "Run the commands in this file, one per line, and exit")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Print the raw protocol bytes sent and received")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
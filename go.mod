@@ -2,8 +2,13 @@ module medis
 
 go 1.22
 
+require (
+	github.com/chzyer/readline v1.5.1
+	github.com/spf13/cobra v1.8.1
+)
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.8.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
 )
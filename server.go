@@ -2,192 +2,3092 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/spf13/cobra"
+	"io"
 	"log"
+	"math"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+var (
+	errSyntax            = errors.New("syntax error")
+	errInvalidExpireTime = errors.New("invalid expire time")
+	errInlineTooBig      = errors.New("Protocol error: too big inline request")
+	errUnbalancedQuotes  = errors.New("Protocol error: unbalanced quotes in request")
+	errNewlineInArg      = errors.New("Protocol error: CR or LF in argument")
+	errNotFloat          = errors.New("value is not a valid float")
+	errNaNOrInfinity     = errors.New("increment would produce NaN or Infinity")
+	errNotInteger        = errors.New("value is not an integer or out of range")
+	errNoSuchKey         = errors.New("no such key")
+	errUnknownCommand    = errors.New("unknown command")
+	errNoScript          = &redisError{code: "NOSCRIPT", msg: "No matching script. Please use EVAL."}
+	errRateLimit         = errors.New("rate limit exceeded")
+	errOOM               = &redisError{code: "OOM", msg: "command not allowed when used memory > 'maxmemory'."}
+)
+
+// redisError is an error reply with an uppercase code, such as ERR or
+// NOSCRIPT, that clients can match on without parsing the message.
+type redisError struct {
+	code, msg string
+}
+
+func (e *redisError) Error() string {
+	return e.code + " " + e.msg
+}
+
+// errorReply formats err as an error reply line, "-CODE message". Errors
+// that aren't a redisError get the generic ERR code.
+func errorReply(err error) string {
+	var re *redisError
+	if !errors.As(err, &re) {
+		re = &redisError{code: "ERR", msg: err.Error()}
+	}
+	return "-" + re.Error() + "\n"
+}
+
+// writeError replies with err; see errorReply.
+func writeError(w io.Writer, err error) {
+	_, _ = w.Write([]byte(errorReply(err)))
+}
+
+// version identifies the build. Release builds set it with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// startTime is when the process started, for uptime reporting.
+var startTime = time.Now()
+
+// runID identifies this run of the server, like Redis's run_id.
+var runID = newReplID()
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+)
+
+// minLogLevel is the least severe level that is written to the log.
+var minLogLevel = levelInfo
+
+// maxInlineLen is the longest command line, in bytes, a client may send.
+var maxInlineLen = 64 * 1024
+
+// latencyThreshold is the shortest command or expiry cycle recorded by the
+// latency monitor; 0 turns the monitor off.
+var latencyThreshold time.Duration
+
+// clientRateLimit is the average number of commands per second each
+// connection may send, in bursts of up to as many; 0 means no limit.
+var clientRateLimit int
+
+// injectedLatency delays each command named in it by the given duration
+// before it runs, for testing how clients cope with a slow server.
+var injectedLatency = map[string]time.Duration{}
+
+// shutdownRequests receives a value when a client sends SHUTDOWN.
+var shutdownRequests = make(chan struct{}, 1)
+
+// tcpKeepAlive is the keepalive probe period for TCP clients; 0 disables
+// keepalives so dead peers are only noticed when a write fails.
+var tcpKeepAlive = 300 * time.Second
+
+// expiryIndex makes each MiniRedis expire keys exactly when their TTL runs
+// out instead of on the periodic sweep, at the cost of indexing every expiry.
+var expiryIndex bool
+
+// parseMemory parses a memory size the way Redis's config does: a number of
+// bytes with an optional unit, where k, m and g are powers of 1000 and kb, mb
+// and gb powers of 1024.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	}
+	digits, scale := strings.ToLower(s), int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(digits, unit.suffix) {
+			digits, scale = strings.TrimSuffix(digits, unit.suffix), unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/scale {
+		return 0, fmt.Errorf("%q is not a memory size", s)
+	}
+	return n * scale, nil
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q: want debug, info or warn", s)
+}
+
+func logf(level logLevel, format string, args ...any) {
+	if level < minLogLevel {
+		return
+	}
+	log.Printf(format, args...)
+}
+
 type MiniRedis struct {
 	mu   sync.RWMutex
 	data map[string]valueWithExpiry
+
+	// usedMemory is the sum of size over every entry in data.
+	usedMemory int64
+	// expiredKeys counts keys removed because their TTL ran out.
+	expiredKeys int64
+	// evictedKeys counts keys removed to bring usedMemory under maxMemory.
+	evictedKeys int64
+
+	// maxMemory caps usedMemory, enforced before commands that add data by
+	// evicting keys as evictionPolicy says; 0 means no limit.
+	maxMemory      int64
+	evictionPolicy string
+
+	// replID and replOffset stand in for replication state: a random ID that
+	// DEBUG CHANGE-REPL-ID replaces, and the number of bytes of write
+	// commands executed, as Redis would propagate them to replicas.
+	replID     string
+	replOffset int64
+
+	// scanOrder lists keys by seq for SCAN, with nextSeq the seq the next
+	// new key gets. Removed keys stay in scanOrder until enough pile up to
+	// compact it.
+	scanOrder []scanEntry
+	nextSeq   uint64
+
+	// commandStats counts calls and time spent per command.
+	commandStats commandStats
+
+	// latency records slow commands and expiry cycles for LATENCY.
+	latency latencyMonitor
+
+	// scripts caches script sources by their SHA1 digest for EVALSHA.
+	scripts map[string]string
+	// procedures holds the command sequences stored with REGISTER.
+	procedures map[string]*procedure
+
+	// activeExpireOff pauses the background expiry goroutine, leaving keys
+	// to expire only when they are accessed.
+	activeExpireOff bool
+
+	// expiries orders keys by expiry for the expiry index, and expiryWake
+	// tells its goroutine an earlier expiry arrived. Both are nil when the
+	// index is off.
+	expiries   *expiryHeap
+	expiryWake chan struct{}
+
+	// defaultTTL is the expiry Set gives keys stored without one; 0 means
+	// such keys never expire.
+	defaultTTL time.Duration
+
+	// rand drives every random choice; see SetRandSource.
+	rand *mathrand.Rand
+
+	// ttlJitter is the fraction (0 to 1) by which Set randomly shortens or
+	// lengthens each expiry so keys set together don't all expire together.
+	ttlJitter float64
 }
 
 type valueWithExpiry struct {
-	value  string
-	expiry time.Time
+	value       string
+	expiry      time.Time
+	accessCount int64
+	// lastAccess is when the key was last read or written, for LRU eviction.
+	lastAccess time.Time
+
+	// intEncoded is set when value is a canonical integer, which is then
+	// also kept parsed in intValue.
+	intEncoded bool
+	intValue   int64
+
+	// seq is the key's position in the scan order, assigned by store when
+	// the key is created and kept for as long as it exists.
+	seq uint64
+}
+
+// setValue stores s as the entry's value, recording whether it's int-encoded.
+func (v *valueWithExpiry) setValue(s string) {
+	v.value = s
+	n, err := strconv.ParseInt(s, 10, 64)
+	v.intEncoded = err == nil && strconv.FormatInt(n, 10) == s
+	if v.intEncoded {
+		v.intValue = n
+	} else {
+		v.intValue = 0
+	}
+}
+
+// encoding names the representation Redis would use for the value: int for
+// canonical integers, embstr for short strings and raw for the rest.
+func (v valueWithExpiry) encoding() string {
+	switch {
+	case v.intEncoded:
+		return "int"
+	case len(v.value) <= 44:
+		return "embstr"
+	}
+	return "raw"
+}
+
+// entryOverhead approximates the fixed cost of one key beyond its key and
+// value bytes: the valueWithExpiry struct (64 bytes), the key's string
+// header (16 bytes) and its share of the map's buckets (16 bytes).
+const entryOverhead = 96
+
+// size approximates the bytes used by the entry stored under key as
+//
+//	len(key) + value bytes + entryOverhead
+//
+// where an int-encoded value counts as 8 bytes and any other value as its
+// length. used_memory is the sum of this over every key.
+func (v valueWithExpiry) size(key string) int64 {
+	if v.intEncoded {
+		return int64(len(key)) + 8 + entryOverhead
+	}
+	return int64(len(key)+len(v.value)) + entryOverhead
 }
 
 func NewMiniRedis() *MiniRedis {
 	mr := &MiniRedis{
-		data: make(map[string]valueWithExpiry),
+		data:       make(map[string]valueWithExpiry),
+		scripts:    make(map[string]string),
+		procedures: make(map[string]*procedure),
+		replID:     newReplID(),
+		nextSeq:    1,
+		rand:       mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+	if expiryIndex {
+		mr.expiries = &expiryHeap{}
+		mr.expiryWake = make(chan struct{}, 1)
+		go mr.expireIndexedKeys()
+	} else {
+		go mr.cleanupExpiredKeys(time.Second * 3)
 	}
-	go mr.cleanupExpiredKeys(time.Second * 3)
 	return mr
 }
 
+// lookup returns the live entry for key, removing it first if it has
+// expired. The caller must hold m.mu.
+func (m *MiniRedis) lookup(key string) (valueWithExpiry, bool) {
+	v, ok := m.data[key]
+	if !ok {
+		return valueWithExpiry{}, false
+	}
+	if !v.expiry.IsZero() && !v.expiry.After(time.Now()) {
+		m.remove(key)
+		m.expiredKeys++
+		return valueWithExpiry{}, false
+	}
+	return v, true
+}
+
+// store writes v under key, keeping usedMemory in step. The caller must
+// hold m.mu.
+func (m *MiniRedis) store(key string, v valueWithExpiry) {
+	v.lastAccess = time.Now()
+	old, existed := m.data[key]
+	if existed {
+		m.usedMemory -= old.size(key)
+		v.seq = old.seq
+	} else {
+		v.seq = m.nextSeq
+		m.nextSeq++
+		m.scanOrder = append(m.scanOrder, scanEntry{seq: v.seq, key: key})
+	}
+	m.data[key] = v
+	m.usedMemory += v.size(key)
+	// Reads store entries back to count accesses; their expiry is already
+	// indexed.
+	if m.expiries != nil && !v.expiry.IsZero() && !(existed && old.expiry.Equal(v.expiry)) {
+		m.indexExpiry(key, v.expiry)
+	}
+}
+
+// remove deletes key, keeping usedMemory in step. The caller must hold m.mu.
+func (m *MiniRedis) remove(key string) bool {
+	old, ok := m.data[key]
+	if !ok {
+		return false
+	}
+	delete(m.data, key)
+	m.usedMemory -= old.size(key)
+	if len(m.scanOrder) > 2*len(m.data)+1024 {
+		live := m.scanOrder[:0]
+		for _, e := range m.scanOrder {
+			if v, ok := m.data[e.key]; ok && v.seq == e.seq {
+				live = append(live, e)
+			}
+		}
+		m.scanOrder = live
+	}
+	return true
+}
+
+// scanEntry places key in the scan order. It's stale once the key is gone
+// or was recreated with a later seq.
+type scanEntry struct {
+	seq uint64
+	key string
+}
+
+// Scan examines up to count keys from cursor on in scan order and returns
+// the live ones matching pattern, with the cursor to continue from, or 0
+// once the scan is complete. A scan starts from cursor 0.
+//
+// Keys keep their place in the scan order from creation to removal, and the
+// cursor only moves forward through it, so a full scan returns every key
+// that exists throughout it exactly once. Keys created during the scan may
+// or may not be returned.
+func (m *MiniRedis) Scan(cursor uint64, pattern string, count int) (uint64, []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	i := sort.Search(len(m.scanOrder), func(i int) bool { return m.scanOrder[i].seq >= cursor })
+	keys := []string{}
+	// count can be as large as math.MaxInt, so adding it to i could overflow.
+	for end := i + min(count, len(m.scanOrder)-i); i < end; i++ {
+		e := m.scanOrder[i]
+		v, ok := m.data[e.key]
+		if !ok || v.seq != e.seq || !v.expiry.IsZero() && !v.expiry.After(now) {
+			continue
+		}
+		if pattern == "" || stringMatch(pattern, e.key) {
+			keys = append(keys, e.key)
+		}
+	}
+	if i == len(m.scanOrder) {
+		return 0, keys
+	}
+	return m.scanOrder[i].seq, keys
+}
+
 func (m *MiniRedis) Set(key, value string, expiresDuration *time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if expiresDuration == nil && m.defaultTTL > 0 {
+		expiresDuration = &m.defaultTTL
+	}
 	var expiry time.Time
 	if expiresDuration != nil && expiresDuration.Seconds() > 0 {
-		expiry = time.Now().Add(*expiresDuration)
+		d := *expiresDuration
+		if m.ttlJitter > 0 {
+			// Scale by a factor in [1-jitter, 1+jitter), never going below 1ms.
+			d = time.Duration(float64(d) * (1 + m.ttlJitter*(2*m.rand.Float64()-1)))
+			d = max(d, time.Millisecond)
+		}
+		expiry = time.Now().Add(d)
+	}
+	old, _ := m.lookup(key)
+	entry := valueWithExpiry{
+		expiry:      expiry,
+		accessCount: old.accessCount + 1,
 	}
-	m.data[key] = valueWithExpiry{
-		value:  value,
-		expiry: expiry,
+	entry.setValue(value)
+	m.store(key, entry)
+}
+
+// SetKeepTTL stores value at key like Set but keeps the expiry of the
+// existing key, if any, instead of clearing it.
+func (m *MiniRedis) SetKeepTTL(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, _ := m.lookup(key)
+	entry := valueWithExpiry{
+		expiry:      old.expiry,
+		accessCount: old.accessCount + 1,
 	}
+	entry.setValue(value)
+	m.store(key, entry)
 }
 
 func (m *MiniRedis) Get(key string) (string, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	v, ok := m.data[key]
+	return m.get(key)
+}
+
+// get returns the value at key, counting the access. The caller must hold
+// m.mu.
+func (m *MiniRedis) get(key string) (string, bool) {
+	v, ok := m.lookup(key)
 	if !ok {
 		return "", false
 	}
-	if v.expiry.IsZero() || v.expiry.After(time.Now()) {
-		return v.value, true
-	} else {
-		delete(m.data, key)
-	}
-	return "", false
+	v.accessCount++
+	m.store(key, v)
+	return v.value, true
 }
 
-func (m *MiniRedis) Delete(key string) {
+// GetWithTTL returns the value at key together with its TTL in seconds, read
+// under one lock so the two agree. The TTL is -1 for a key without an expiry
+// and -2, with ok false, for a missing key.
+func (m *MiniRedis) GetWithTTL(key string) (value string, ttl int64, ok bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.data, key)
+	value, ok = m.get(key)
+	ttl, _ = m.ttl(key)
+	return value, ttl, ok
+}
+
+// Delete removes the given keys and returns how many of them existed.
+func (m *MiniRedis) Delete(keys ...string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := m.lookup(key); ok {
+			m.remove(key)
+			deleted++
+		}
+	}
+	return deleted
 }
 
 func (m *MiniRedis) TTL(key string) (int64, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	v, ok := m.data[key]
+	return m.ttl(key)
+}
+
+// MTTL returns the TTL of each key, in order, using the same -2 (missing)
+// and -1 (no expiry) conventions as TTL.
+func (m *MiniRedis) MTTL(keys []string) []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ttls := make([]int64, len(keys))
+	for i, key := range keys {
+		ttls[i], _ = m.ttl(key)
+	}
+	return ttls
+}
+
+// ttl reports the remaining seconds to live of key. The caller must hold m.mu.
+func (m *MiniRedis) ttl(key string) (int64, bool) {
+	v, ok := m.lookup(key)
 	if !ok {
 		return -2, false
 	}
 	if v.expiry.IsZero() {
 		return -1, true
 	}
-	if v.expiry.After(time.Now()) {
-		return int64(v.expiry.Sub(time.Now()).Seconds()), true
+	return int64(math.Round(time.Until(v.expiry).Seconds())), true
+}
+
+// MExpire sets the same time to live on every existing key in keys under a
+// single lock and returns how many keys were updated.
+func (m *MiniRedis) MExpire(keys []string, ttl time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiry := time.Now().Add(ttl)
+	updated := 0
+	for _, key := range keys {
+		v, ok := m.lookup(key)
+		if !ok {
+			continue
+		}
+		v.expiry = expiry
+		m.store(key, v)
+		updated++
 	}
-	delete(m.data, key)
-	return -2, false
+	return updated
 }
 
-func (m *MiniRedis) cleanupExpiredKeys(interval time.Duration) {
-	ticker := time.NewTicker(interval)
+// CompareAndSet replaces the value at key with newValue only if it currently
+// holds expected. A missing key never matches. The key's expiry is kept.
+func (m *MiniRedis) CompareAndSet(key, expected, newValue string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key)
+	if !ok || v.value != expected {
+		return false
+	}
+	v.setValue(newValue)
+	v.accessCount++
+	m.store(key, v)
+	return true
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			m.mu.Lock()
-			now := time.Now()
-			for k, v := range m.data {
-				if !v.expiry.IsZero() && v.expiry.Before(now) {
-					delete(m.data, k)
-				}
-			}
-			m.mu.Unlock()
+// IncrByFloat adds incr to the float stored at key, treating a missing key
+// as 0, and returns the new value. The key's expiry is left untouched.
+func (m *MiniRedis) IncrByFloat(key string, incr float64) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key)
+	var current float64
+	if ok && v.intEncoded {
+		current = float64(v.intValue)
+	} else if ok {
+		f, err := strconv.ParseFloat(v.value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, errNotFloat
 		}
+		current = f
+	}
+	result := current + incr
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, errNaNOrInfinity
 	}
+	v.setValue(formatFloat(result))
+	v.accessCount++
+	m.store(key, v)
+	return result, nil
 }
 
-func main() {
-	mr := NewMiniRedis()
+// formatFloat renders f in plain decimal notation with no trailing zeros,
+// the way Redis replies to INCRBYFLOAT.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
 
-	listener, err := net.Listen("tcp", ":6379")
-	if err != nil {
-		panic(err)
+// Object returns a copy of the entry at key without counting it as an
+// access, so that its value, expiry and encoding are all read together.
+func (m *MiniRedis) Object(key string) (valueWithExpiry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lookup(key)
+}
+
+// Encoding returns the name of the encoding used for the value at key.
+func (m *MiniRedis) Encoding(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key)
+	if !ok {
+		return "", false
 	}
-	defer func(listener net.Listener) {
-		_ = listener.Close()
-	}(listener)
+	return v.encoding(), true
+}
 
-	log.Println("Server is running on port 6379")
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection: ", err)
-			continue
+// MemoryUsage returns the approximate number of bytes used by key and its value.
+func (m *MiniRedis) MemoryUsage(key string) (int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	return v.size(key), true
+}
+
+// AccessCount returns how many times the key has been read or written
+// since it was created. It does not count as an access itself.
+func (m *MiniRedis) AccessCount(key string) (int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key)
+	return v.accessCount, ok
+}
+
+// LoadScript caches src for EVALSHA and returns its SHA1 digest.
+func (m *MiniRedis) LoadScript(src string) string {
+	sum := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(sum[:])
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scripts[sha] = src
+	return sha
+}
+
+// Script returns the cached source for the SHA1 digest sha.
+func (m *MiniRedis) Script(sha string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	src, ok := m.scripts[strings.ToLower(sha)]
+	return src, ok
+}
+
+// FlushScripts empties the script cache.
+func (m *MiniRedis) FlushScripts() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scripts = make(map[string]string)
+}
+
+// Register stores p under name, replacing any procedure already there.
+func (m *MiniRedis) Register(name string, p *procedure) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.procedures[name] = p
+}
+
+// Procedure returns the procedure registered under name.
+func (m *MiniRedis) Procedure(name string) (*procedure, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.procedures[name]
+	return p, ok
+}
+
+// SetActiveExpire pauses or resumes background expiry. While paused, keys
+// only expire when a command looks them up.
+func (m *MiniRedis) SetActiveExpire(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeExpireOff = !enabled
+	if enabled && m.expiryWake != nil {
+		select {
+		case m.expiryWake <- struct{}{}:
+		default:
 		}
-		go handleRequest(conn, mr)
 	}
 }
 
-func handleRequest(conn net.Conn, mr *MiniRedis) {
-	defer func(conn net.Conn) {
-		_ = conn.Close()
-	}(conn)
+// KeyInfo describes a key for KEYSINFO. TTL is in seconds, or -1 if the
+// key doesn't expire.
+type KeyInfo struct {
+	Key  string
+	Type string
+	TTL  int64
+}
 
-	reader := bufio.NewReader(conn)
-	for {
-		cmdLine, err := reader.ReadString('\n')
-		if err != nil {
-			log.Println("Error reading command: ", err)
-			return
+// KeysInfo describes the live keys matching the glob pattern, sorted by
+// name and read under a single lock. At most count keys are returned unless
+// count is 0.
+func (m *MiniRedis) KeysInfo(pattern string, count int) []KeyInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var infos []KeyInfo
+	for k, v := range m.data {
+		if !v.expiry.IsZero() && !v.expiry.After(now) || !stringMatch(pattern, k) {
+			continue
 		}
-		cmdLine = strings.TrimSpace(cmdLine)
-		cmdParts := strings.Fields(cmdLine)
-		action := strings.ToUpper(cmdParts[0])
-		log.Println("cmd: ", cmdParts)
-		switch action {
-		case "SET":
-			if len(cmdParts) < 3 {
-				_, _ = conn.Write([]byte("ERR wrong number of arguments for 'SET' command\n"))
-				continue
-			}
-			var expiresDuration *time.Duration
-			if len(cmdParts) == 5 && strings.ToUpper(cmdParts[3]) == "EX" {
-				seconds := cmdParts[4]
-				duration, err := time.ParseDuration(seconds + "s")
-				if err != nil {
-					_, _ = conn.Write([]byte("ERR invalid expire time\n"))
-					continue
-				}
-				expiresDuration = &duration
-			}
-			mr.Set(cmdParts[1], cmdParts[2], expiresDuration)
-			_, _ = conn.Write([]byte("OK\n"))
-		case "GET":
-			if len(cmdParts) != 2 {
-				_, _ = conn.Write([]byte("-ERR wrong number of arguments for 'GET' command\n"))
-				continue
-			}
-			value, ok := mr.Get(cmdParts[1])
-			if !ok {
-				_, _ = conn.Write([]byte("$-1\n"))
-				continue
-			}
-			log.Println("value: ", value)
-			_, _ = conn.Write([]byte(fmt.Sprintf("$%s\n", value)))
-		case "DEL":
-			if len(cmdParts) != 2 {
-				_, _ = conn.Write([]byte("-ERR wrong number of arguments for 'DEL' command\n"))
-				continue
-			}
-			mr.Delete(cmdParts[1])
-			_, _ = conn.Write([]byte("OK\n"))
-		case "TTL":
-			if len(cmdParts) != 2 {
-				_, _ = conn.Write([]byte("-ERR wrong number of arguments for 'TTL' command\n"))
-				continue
-			}
-			ttl, ok := mr.TTL(cmdParts[1])
-			if !ok {
-				_, _ = conn.Write([]byte("-2\n"))
-				continue
-			}
-			_, _ = conn.Write([]byte(strconv.FormatInt(ttl, 10) + "\n"))
-		default:
-			_, _ = conn.Write([]byte("-ERR unknown command\n"))
+		// Every value is a string.
+		info := KeyInfo{Key: k, Type: "string", TTL: -1}
+		if !v.expiry.IsZero() {
+			info.TTL = int64(math.Round(v.expiry.Sub(now).Seconds()))
 		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	if count > 0 && len(infos) > count {
+		infos = infos[:count]
+	}
+	return infos
+}
+
+// KeyspaceStats is a point-in-time view of the keyspace counters.
+type KeyspaceStats struct {
+	Keys        int
+	UsedMemory  int64
+	ExpiredKeys int64
+	EvictedKeys int64
+}
+
+func (m *MiniRedis) Stats() KeyspaceStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return KeyspaceStats{
+		Keys:        len(m.data),
+		UsedMemory:  m.usedMemory,
+		ExpiredKeys: m.expiredKeys,
+		EvictedKeys: m.evictedKeys,
+	}
+}
+
+// Replication returns the replication ID and offset.
+func (m *MiniRedis) Replication() (string, int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replID, m.replOffset
+}
+
+// ChangeReplID replaces the replication ID with a new random one.
+func (m *MiniRedis) ChangeReplID() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replID = newReplID()
+}
+
+// propagate advances the replication offset by the size of args encoded as
+// a RESP array, which is what Redis sends replicas for a write command.
+// Like Redis, handlers only propagate writes that changed the keyspace, so
+// failed writes and no-ops such as deleting missing keys don't count.
+func (m *MiniRedis) propagate(args []string) {
+	n := len("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		n += len("$"+strconv.Itoa(len(arg))+"\r\n") + len(arg) + len("\r\n")
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replOffset += int64(n)
+}
 
+// newReplID returns 40 random hex characters, the form Redis uses for run
+// and replication IDs.
+func newReplID() string {
+	var b [20]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// evictionPolicies are the supported values of --maxmemory-policy.
+var evictionPolicies = []string{"noeviction", "allkeys-lru", "allkeys-random", "volatile-ttl"}
+
+// evictionSamples is how many keys the LRU and TTL policies compare to pick
+// one to evict. Like Redis, they approximate by sampling rather than keeping
+// every key ordered.
+const evictionSamples = 5
+
+// FreeMemory evicts keys under the eviction policy until usedMemory is within
+// maxMemory. It returns errOOM when the policy can't evict anything more.
+func (m *MiniRedis) FreeMemory() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.maxMemory > 0 && m.usedMemory > m.maxMemory {
+		key, ok := m.evictionCandidate()
+		if !ok {
+			return errOOM
+		}
+		// A key that has already expired is removed by lookup and counted
+		// as expired, not evicted.
+		if _, ok := m.lookup(key); !ok {
+			continue
+		}
+		m.remove(key)
+		m.evictedKeys++
+	}
+	return nil
+}
+
+// evictionCandidate picks the key the eviction policy would evict next. The
+// caller must hold m.mu.
+func (m *MiniRedis) evictionCandidate() (string, bool) {
+	switch m.evictionPolicy {
+	case "allkeys-random":
+		key, _, ok := m.randomEntry()
+		return key, ok
+	case "allkeys-lru", "volatile-ttl":
+	default:
+		return "", false
+	}
+
+	volatileOnly := m.evictionPolicy == "volatile-ttl"
+	var best string
+	var bestEntry valueWithExpiry
+	sampled := 0
+	for draws := 0; sampled < evictionSamples && draws < 10*evictionSamples; draws++ {
+		key, v, ok := m.randomEntry()
+		if !ok {
+			break
+		}
+		if volatileOnly && v.expiry.IsZero() {
+			continue
+		}
+		if sampled == 0 || volatileOnly && v.expiry.Before(bestEntry.expiry) ||
+			!volatileOnly && v.lastAccess.Before(bestEntry.lastAccess) {
+			best, bestEntry = key, v
+		}
+		sampled++
+	}
+	if sampled == 0 && volatileOnly {
+		// With few keys having a TTL the draws can miss them all, so fall
+		// back to the first one in scan order.
+		for _, e := range m.scanOrder {
+			if v, ok := m.data[e.key]; ok && v.seq == e.seq && !v.expiry.IsZero() {
+				return e.key, true
+			}
+		}
+	}
+	return best, sampled > 0
+}
+
+// randomEntry picks a key uniformly at random with m.rand. It may pick a
+// key that has expired but not been removed yet. The caller must hold m.mu.
+func (m *MiniRedis) randomEntry() (string, valueWithExpiry, bool) {
+	if len(m.data) == 0 {
+		return "", valueWithExpiry{}, false
+	}
+	// Every live key has exactly one entry in scanOrder that isn't stale,
+	// so drawing until a live one comes up is uniform over keys.
+	for {
+		e := m.scanOrder[m.rand.Intn(len(m.scanOrder))]
+		if v, ok := m.data[e.key]; ok && v.seq == e.seq {
+			return e.key, v, true
+		}
+	}
+}
+
+// RandomKey returns a random live key.
+func (m *MiniRedis) RandomKey() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		key, _, ok := m.randomEntry()
+		if !ok {
+			return "", false
+		}
+		// lookup removes the key if it has expired, so the next draw can't
+		// pick it again.
+		if _, ok := m.lookup(key); ok {
+			return key, true
+		}
+	}
+}
+
+// SetRandSource replaces the randomness behind RANDOMKEY, TTL jitter and
+// eviction sampling, so tests can seed it and get repeatable results.
+func (m *MiniRedis) SetRandSource(src mathrand.Source) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rand = mathrand.New(src)
+}
+
+func (m *MiniRedis) cleanupExpiredKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			m.mu.Lock()
+			if m.activeExpireOff {
+				m.mu.Unlock()
+				continue
+			}
+			now := time.Now()
+			for k, v := range m.data {
+				if !v.expiry.IsZero() && v.expiry.Before(now) {
+					m.remove(k)
+					m.expiredKeys++
+				}
+			}
+			m.mu.Unlock()
+			m.latency.add("expire-cycle", time.Since(now))
+		}
+	}
+}
+
+// expiryEntry records that key was set to expire at expiry. Entries are
+// never updated: one is stale once its key is gone or has another expiry.
+type expiryEntry struct {
+	key    string
+	expiry time.Time
+}
+
+// expiryHeap is a min-heap of expiry entries for container/heap.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryEntry)) }
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// indexExpiry adds key's new expiry to the index, waking the expiry
+// goroutine if it's now the earliest. Once stale entries outnumber live
+// keys the index is rebuilt so it can't grow without bound. The caller must
+// hold m.mu.
+func (m *MiniRedis) indexExpiry(key string, expiry time.Time) {
+	if m.expiries.Len() > 2*len(m.data)+1024 {
+		live := (*m.expiries)[:0]
+		for _, e := range *m.expiries {
+			if v, ok := m.data[e.key]; ok && v.expiry.Equal(e.expiry) {
+				live = append(live, e)
+			}
+		}
+		*m.expiries = live
+		heap.Init(m.expiries)
+	}
+	heap.Push(m.expiries, expiryEntry{key: key, expiry: expiry})
+	if (*m.expiries)[0].key == key && (*m.expiries)[0].expiry.Equal(expiry) {
+		select {
+		case m.expiryWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expireIndexedKeys removes keys as their expiries come due, sleeping until
+// the earliest one in the index or until an earlier one is added.
+func (m *MiniRedis) expireIndexedKeys() {
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		expired := false
+		for !m.activeExpireOff && m.expiries.Len() > 0 && !(*m.expiries)[0].expiry.After(now) {
+			e := heap.Pop(m.expiries).(expiryEntry)
+			if v, ok := m.data[e.key]; ok && v.expiry.Equal(e.expiry) {
+				m.remove(e.key)
+				m.expiredKeys++
+			}
+			expired = true
+		}
+		wait := time.Hour
+		if !m.activeExpireOff && m.expiries.Len() > 0 {
+			wait = (*m.expiries)[0].expiry.Sub(now)
+		}
+		m.mu.Unlock()
+		if expired {
+			m.latency.add("expire-cycle", time.Since(now))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-m.expiryWake:
+			timer.Stop()
+		}
+	}
+}
+
+// cmdStat accumulates the calls to one command.
+type cmdStat struct {
+	calls int64
+	total time.Duration
+}
+
+// commandStats records how often each command runs and for how long. The
+// zero value is ready to use.
+type commandStats struct {
+	mu    sync.Mutex
+	stats map[string]*cmdStat
+}
+
+// add records a call to command that took d.
+func (c *commandStats) add(command string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*cmdStat)
+	}
+	stat, ok := c.stats[command]
+	if !ok {
+		stat = &cmdStat{}
+		c.stats[command] = stat
+	}
+	stat.calls++
+	stat.total += d
+}
+
+// infoLines formats the stats as INFO commandstats lines, sorted by
+// command name.
+func (c *commandStats) infoLines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := make([]string, 0, len(c.stats))
+	for name, stat := range c.stats {
+		usec := stat.total.Microseconds()
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f",
+			strings.ToLower(name), stat.calls, usec, float64(usec)/float64(stat.calls)))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// latencyHistoryLen is how many samples the latency monitor keeps per event.
+const latencyHistoryLen = 160
+
+// latencySample is the worst latency of an event within one second.
+type latencySample struct {
+	time    int64 // Unix seconds
+	latency int64 // milliseconds
+}
+
+type latencyEvent struct {
+	history []latencySample
+	max     int64
+}
+
+// latencyMonitor records events, such as "command" or "expire-cycle", that
+// took at least latencyThreshold. The zero value is ready to use.
+type latencyMonitor struct {
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+// add records that event took d, if that reaches the threshold.
+func (l *latencyMonitor) add(event string, d time.Duration) {
+	if latencyThreshold <= 0 || d < latencyThreshold {
+		return
+	}
+	ms, now := d.Milliseconds(), time.Now().Unix()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.events == nil {
+		l.events = make(map[string]*latencyEvent)
+	}
+	e, ok := l.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		l.events[event] = e
+	}
+	e.max = max(e.max, ms)
+	if n := len(e.history); n > 0 && e.history[n-1].time == now {
+		e.history[n-1].latency = max(e.history[n-1].latency, ms)
+		return
+	}
+	e.history = append(e.history, latencySample{time: now, latency: ms})
+	if len(e.history) > latencyHistoryLen {
+		e.history = e.history[1:]
+	}
+}
+
+// latencyLatest is an event's most recent sample along with its all-time
+// maximum.
+type latencyLatest struct {
+	event string
+	latencySample
+	max int64
+}
+
+// latest returns the latest sample of every event, sorted by event name.
+func (l *latencyMonitor) latest() []latencyLatest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	latest := make([]latencyLatest, 0, len(l.events))
+	for name, e := range l.events {
+		latest = append(latest, latencyLatest{event: name, latencySample: e.history[len(e.history)-1], max: e.max})
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].event < latest[j].event })
+	return latest
+}
+
+// history returns the samples recorded for event, oldest first.
+func (l *latencyMonitor) history(event string) []latencySample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.events[event]; ok {
+		return append([]latencySample(nil), e.history...)
+	}
+	return nil
+}
+
+// reset forgets the given events, or every event if none are given, and
+// returns how many were forgotten.
+func (l *latencyMonitor) reset(events ...string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(events) == 0 {
+		n := len(l.events)
+		l.events = nil
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := l.events[event]; ok {
+			delete(l.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+func main() {
+	var bind, unixSocket, level, pidFile, healthAddr string
+	var maxClients int
+	var ttlJitter float64
+	var defaultTTL time.Duration
+	var maxMemory, maxMemoryPolicy string
+	var latencyInjections []string
+
+	var rootCmd = &cobra.Command{
+		Use:     "medis-server",
+		Short:   "A simple MiniRedis server",
+		Version: version,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if minLogLevel, err = parseLogLevel(level); err != nil {
+				return err
+			}
+			if ttlJitter < 0 || ttlJitter > 100 {
+				return errors.New("--ttl-jitter must be between 0 and 100")
+			}
+			if defaultTTL < 0 {
+				return errors.New("--default-ttl can't be negative")
+			}
+			for _, injection := range latencyInjections {
+				name, ms, ok := strings.Cut(injection, "=")
+				name = strings.ToUpper(name)
+				n, err := strconv.Atoi(ms)
+				if _, known := commandTable[name]; !ok || !known || err != nil || n < 0 {
+					return fmt.Errorf("invalid --inject-latency %q: want COMMAND=milliseconds", injection)
+				}
+				injectedLatency[name] = time.Duration(n) * time.Millisecond
+			}
+			maxMemoryBytes, err := parseMemory(maxMemory)
+			if err != nil {
+				return fmt.Errorf("invalid --maxmemory: %w", err)
+			}
+			if !slices.Contains(evictionPolicies, maxMemoryPolicy) {
+				return fmt.Errorf("invalid --maxmemory-policy %q: want one of %s", maxMemoryPolicy, strings.Join(evictionPolicies, ", "))
+			}
+			if bind == "" && unixSocket == "" {
+				return errors.New("nothing to listen on: set --bind or --unixsocket")
+			}
+
+			listeners, err := listen(bind, unixSocket)
+			if err != nil {
+				return err
+			}
+			defer closeListeners(listeners)
+
+			// Every connection holds a slot for as long as it's being served;
+			// a nil channel means there is no limit.
+			var clientSlots chan struct{}
+			if maxClients > 0 {
+				clientSlots = make(chan struct{}, maxClients)
+			}
+
+			mr := NewMiniRedis()
+			mr.ttlJitter = ttlJitter / 100
+			mr.defaultTTL = defaultTTL
+			mr.maxMemory = maxMemoryBytes
+			mr.evictionPolicy = maxMemoryPolicy
+			if pidFile != "" {
+				if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+					return err
+				}
+				defer func() {
+					_ = os.Remove(pidFile)
+				}()
+			}
+
+			// ready tells /readyz the server is accepting commands.
+			var ready atomic.Bool
+			if healthAddr != "" {
+				healthListener, err := net.Listen("tcp", healthAddr)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					_ = healthListener.Close()
+				}()
+				go serveHealth(healthListener, &ready)
+			}
+
+			// Closing the listeners makes every serve call return, which ends
+			// the command and runs the deferred cleanup.
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				select {
+				case sig := <-signals:
+					logf(levelInfo, "Received %s, shutting down", sig)
+				case <-shutdownRequests:
+					logf(levelInfo, "SHUTDOWN requested by a client, shutting down")
+				}
+				ready.Store(false)
+				closeListeners(listeners)
+			}()
+
+			var wg sync.WaitGroup
+			for _, listener := range listeners {
+				wg.Add(1)
+				go func(listener net.Listener) {
+					defer wg.Done()
+					serve(listener, mr, clientSlots)
+				}(listener)
+			}
+			ready.Store(true)
+			wg.Wait()
+			return nil
+		},
+	}
+
+	rootCmd.PersistentFlags().StringVarP(&bind, "bind", "b", ":6379", "Comma-separated TCP addresses to listen on, such as 127.0.0.1:6379,[::1]:6379; empty to disable TCP")
+	rootCmd.PersistentFlags().StringVarP(&unixSocket, "unixsocket", "s", "", "Unix domain socket path to listen on")
+	rootCmd.PersistentFlags().StringVarP(&level, "loglevel", "l", "info", "Log level: debug, info or warn")
+	rootCmd.PersistentFlags().IntVar(&maxClients, "maxclients", 10000, "Maximum number of connected clients, 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&maxInlineLen, "max-inline-len", maxInlineLen, "Maximum length in bytes of a command line")
+	rootCmd.PersistentFlags().IntVar(&clientRateLimit, "client-rate-limit", 0, "Maximum commands per second per connection, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&tcpKeepAlive, "tcp-keepalive", tcpKeepAlive, "Keepalive period for TCP clients, 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&latencyThreshold, "latency-monitor-threshold", 0, "Record commands and expiry cycles taking at least this long for LATENCY, 0 to disable")
+	rootCmd.PersistentFlags().StringArrayVar(&latencyInjections, "inject-latency", nil, "For testing: delay every call to a command, given as COMMAND=milliseconds; repeatable")
+	rootCmd.PersistentFlags().StringVar(&healthAddr, "health-addr", "", "Serve HTTP /healthz and /readyz probes on this address; empty to disable")
+	rootCmd.PersistentFlags().StringVar(&pidFile, "pidfile", "", "Write the process ID to this file while running")
+	rootCmd.PersistentFlags().BoolVar(&expiryIndex, "expiry-index", false, "Expire keys exactly on time using a TTL-ordered index instead of a periodic sweep")
+	rootCmd.PersistentFlags().StringVar(&maxMemory, "maxmemory", "0", "Memory limit such as 100mb, enforced by evicting keys; 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&maxMemoryPolicy, "maxmemory-policy", "noeviction", "What to evict at the memory limit: "+strings.Join(evictionPolicies, ", "))
+	rootCmd.PersistentFlags().DurationVar(&defaultTTL, "default-ttl", 0, "Expiry for keys SET without EX, PX, EXAT, PXAT or KEEPTTL, 0 for none")
+	rootCmd.PersistentFlags().Float64Var(&ttlJitter, "ttl-jitter", 0, "Randomly adjust each SET expiry by up to this percentage")
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// listen opens a TCP listener for each address in the comma-separated bind
+// list and, if unixSocket is set, a Unix socket listener. If any of them
+// fails, the ones already open are closed.
+func listen(bind, unixSocket string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range strings.Split(bind, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if unixSocket != "" {
+		// A socket file left behind by a previous run would make Listen fail.
+		_ = os.Remove(unixSocket)
+		listener, err := net.Listen("unix", unixSocket)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+// serveHealth answers HTTP health probes on listener: /healthz succeeds
+// while the process is up, and /readyz only while ready is set.
+func serveHealth(listener net.Listener, ready *atomic.Bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	logf(levelInfo, "Health checks are served on http://%s", listener.Addr())
+	if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logf(levelWarn, "Health server stopped: %v", err)
+	}
+}
+
+func serve(listener net.Listener, mr *MiniRedis, clientSlots chan struct{}) {
+	defer func(listener net.Listener) {
+		_ = listener.Close()
+	}(listener)
+
+	logf(levelInfo, "Server is listening on %s %s", listener.Addr().Network(), listener.Addr())
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Temporary failures such as running out of file descriptors
+			// get an exponential backoff instead of a busy loop.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				logf(levelWarn, "Error accepting connection: %v; retrying in %s", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			logf(levelWarn, "Stopped accepting connections on %s: %v", listener.Addr(), err)
+			return
+		}
+		backoff = 0
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			setKeepAlive(tcpConn)
+		}
+		if clientSlots != nil {
+			select {
+			case clientSlots <- struct{}{}:
+			default:
+				writeError(conn, errors.New("max number of clients reached"))
+				_ = conn.Close()
+				continue
+			}
+		}
+		c := clients.register(conn)
+		go func() {
+			handleRequest(c, mr)
+			clients.unregister(c)
+			if clientSlots != nil {
+				<-clientSlots
+			}
+		}()
+	}
+}
+
+// setOptions holds the options that may follow the key and value of SET.
+type setOptions struct {
+	// expires is the TTL given by EX or PX, or the time left until the Unix
+	// time given by EXAT or PXAT, which is 0 or less once that has passed.
+	expires *time.Duration
+	keepTTL bool
+}
+
+// parseExpireTime parses a TTL argument given as a whole number of units.
+// Every command that sets a TTL uses it, so they all reject the same
+// inputs: anything but a positive integer, and values too large for a
+// time.Duration.
+func parseExpireTime(s string, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+		return 0, errInvalidExpireTime
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func parseSetOptions(args []string) (setOptions, error) {
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX", "EXAT", "PXAT":
+			if opts.expires != nil || opts.keepTTL || i+1 == len(args) {
+				return opts, errSyntax
+			}
+			option := strings.ToUpper(args[i])
+			unit := time.Second
+			if option[0] == 'P' {
+				unit = time.Millisecond
+			}
+			i++
+			duration, err := parseExpireTime(args[i], unit)
+			if err != nil {
+				return opts, err
+			}
+			if strings.HasSuffix(option, "AT") {
+				duration = time.Until(time.Unix(0, 0).Add(duration))
+			}
+			opts.expires = &duration
+		case "KEEPTTL":
+			if opts.expires != nil || opts.keepTTL {
+				return opts, errSyntax
+			}
+			opts.keepTTL = true
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// stringMatch reports whether s matches the glob pattern the way Redis's
+// KEYS does: * matches any run of bytes, ? any one byte, [abc], [a-z] and
+// [^abc] one byte in or not in a set, and \ escapes the byte after it.
+//
+// Only the last * is ever backtracked to, since every other token matches
+// exactly one byte, so matching takes O(len(pattern)*len(s)) time however
+// many stars there are.
+func stringMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// star is the position of the last * in pattern, or -1 before the
+	// first, and starEnd where in s the bytes it matches end.
+	star, starEnd := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starEnd = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := matchToken(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * match one more byte and retry from after it.
+		starEnd++
+		p, i = star+1, starEnd
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchToken reports whether c matches the token, other than *, at the
+// start of pattern, and returns the token's length.
+func matchToken(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		i := 1
+		not := i < len(pattern) && pattern[i] == '^'
+		if not {
+			i++
+		}
+		match := false
+		for i < len(pattern) && pattern[i] != ']' {
+			switch {
+			case pattern[i] == '\\' && i+1 < len(pattern):
+				i++
+				match = match || pattern[i] == c
+			case i+2 < len(pattern) && pattern[i+1] == '-':
+				lo, hi := min(pattern[i], pattern[i+2]), max(pattern[i], pattern[i+2])
+				match = match || lo <= c && c <= hi
+				i += 2
+			default:
+				match = match || pattern[i] == c
+			}
+			i++
+		}
+		// An unterminated set runs to the end of the pattern.
+		if i < len(pattern) {
+			i++
+		}
+		return i, match != not
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// keySpec locates a command's key arguments the way Redis does: positions
+// first through last, every step, counting the command name as 0. A negative
+// last counts back from the final argument. Commands like EVAL instead set
+// keyCount to the position of an argument holding the number of keys, which
+// then immediately follow it.
+type keySpec struct {
+	first, last, step int
+	keyCount          int
+}
+
+// commandInfo describes how a command is called.
+type commandInfo struct {
+	// minArgs and maxArgs bound the number of arguments including the
+	// command name itself. A maxArgs of -1 means there is no upper bound.
+	minArgs, maxArgs int
+	// write is set for commands that may modify the keyspace.
+	write bool
+	// keys locates the key arguments; the zero value means there are none.
+	keys keySpec
+	// exclusive commands run with every other command locked out.
+	exclusive bool
+	// noScript commands can't be called from a script.
+	noScript bool
+	// denyOOM commands may add data, so they are refused when memory is
+	// over maxmemory and nothing can be evicted.
+	denyOOM bool
+}
+
+// commandMu lets exclusive commands, such as scripts, see the keyspace
+// change only through the commands they issue themselves. Every other
+// command holds it for reading.
+var commandMu sync.RWMutex
+
+// commandTable lists every command the server understands. Argument counts
+// are checked against it before a command runs; commands with subcommands
+// check the subcommand's own arguments themselves.
+var commandTable = map[string]commandInfo{
+	"SET":         {minArgs: 3, maxArgs: -1, write: true, denyOOM: true, keys: keySpec{first: 1, last: 1, step: 1}},
+	"GET":         {minArgs: 2, maxArgs: 2, keys: keySpec{first: 1, last: 1, step: 1}},
+	"GETWITHTTL":  {minArgs: 2, maxArgs: 2, keys: keySpec{first: 1, last: 1, step: 1}},
+	"DEL":         {minArgs: 2, maxArgs: -1, write: true, keys: keySpec{first: 1, last: -1, step: 1}},
+	"TTL":         {minArgs: 2, maxArgs: 2, keys: keySpec{first: 1, last: 1, step: 1}},
+	"MTTL":        {minArgs: 2, maxArgs: -1, keys: keySpec{first: 1, last: -1, step: 1}},
+	"INCRBYFLOAT": {minArgs: 3, maxArgs: 3, write: true, denyOOM: true, keys: keySpec{first: 1, last: 1, step: 1}},
+	"MEXPIRE":     {minArgs: 3, maxArgs: -1, write: true, keys: keySpec{first: 2, last: -1, step: 1}},
+	"CAS":         {minArgs: 4, maxArgs: 4, write: true, denyOOM: true, keys: keySpec{first: 1, last: 1, step: 1}},
+	"EVAL":        {minArgs: 3, maxArgs: -1, write: true, keys: keySpec{keyCount: 2}, exclusive: true, noScript: true},
+	"EVALSHA":     {minArgs: 3, maxArgs: -1, write: true, keys: keySpec{keyCount: 2}, exclusive: true, noScript: true},
+	"SCRIPT":      {minArgs: 2, maxArgs: -1, noScript: true},
+	"REGISTER":    {minArgs: 3, maxArgs: 3, noScript: true},
+	"CALL":        {minArgs: 2, maxArgs: -1, write: true, exclusive: true, noScript: true},
+	"SHUTDOWN":    {minArgs: 1, maxArgs: 2, noScript: true},
+	"CLIENT":      {minArgs: 2, maxArgs: -1, noScript: true},
+	"QUIT":        {minArgs: 1, maxArgs: -1, noScript: true},
+	"RESET":       {minArgs: 1, maxArgs: 1, noScript: true},
+	"VERSION":     {minArgs: 1, maxArgs: 1},
+	"TIME":        {minArgs: 1, maxArgs: 1},
+	"DBSIZE":      {minArgs: 1, maxArgs: 1},
+	"RANDOMKEY":   {minArgs: 1, maxArgs: 1},
+	"KEYSINFO":    {minArgs: 2, maxArgs: 4},
+	"SCAN":        {minArgs: 2, maxArgs: 6},
+	"INFO":        {minArgs: 1, maxArgs: 2},
+	"COMMAND":     {minArgs: 2, maxArgs: -1},
+	"OBJECT":      {minArgs: 3, maxArgs: 3},
+	"CLUSTER":     {minArgs: 2, maxArgs: 2},
+	"MEMORY":      {minArgs: 2, maxArgs: -1},
+	"DEBUG":       {minArgs: 2, maxArgs: -1},
+	"LATENCY":     {minArgs: 2, maxArgs: -1},
+}
+
+// commandDoc documents a command for COMMAND DOCS.
+type commandDoc struct {
+	summary string
+	// arguments lists the command's arguments after its name, in the
+	// syntax of the Redis documentation.
+	arguments []string
+}
+
+// commandDocs documents every command in commandTable.
+var commandDocs = map[string]commandDoc{
+	"SET":         {summary: "Sets the string value of a key, ignoring its type.", arguments: []string{"key", "value", "[EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]"}},
+	"GET":         {summary: "Returns the string value of a key.", arguments: []string{"key"}},
+	"GETWITHTTL":  {summary: "Returns the string value of a key and its time to live in seconds.", arguments: []string{"key"}},
+	"DEL":         {summary: "Deletes one or more keys.", arguments: []string{"key [key ...]"}},
+	"TTL":         {summary: "Returns the time to live in seconds of a key.", arguments: []string{"key"}},
+	"MTTL":        {summary: "Returns the time to live in seconds of each of several keys.", arguments: []string{"key [key ...]"}},
+	"INCRBYFLOAT": {summary: "Increments the floating point value of a key by a number.", arguments: []string{"key", "increment"}},
+	"MEXPIRE":     {summary: "Sets the same time to live in seconds on several keys.", arguments: []string{"seconds", "key [key ...]"}},
+	"CAS":         {summary: "Sets the value of a key only if it currently holds the expected value.", arguments: []string{"key", "expected", "value"}},
+	"EVAL":        {summary: "Executes a server-side script.", arguments: []string{"script", "numkeys", "[key [key ...]]", "[arg [arg ...]]"}},
+	"EVALSHA":     {summary: "Executes a server-side script by SHA1 digest.", arguments: []string{"sha1", "numkeys", "[key [key ...]]", "[arg [arg ...]]"}},
+	"SCRIPT":      {summary: "A container for scripting commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+	"REGISTER":    {summary: "Stores a sequence of commands to run with CALL.", arguments: []string{"name", "commands"}},
+	"CALL":        {summary: "Runs a sequence of commands stored with REGISTER.", arguments: []string{"name", "[arg [arg ...]]"}},
+	"CLIENT":      {summary: "A container for client connection commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+	"SHUTDOWN":    {summary: "Stops the server.", arguments: []string{"[NOSAVE | SAVE]"}},
+	"QUIT":        {summary: "Closes the connection.", arguments: []string{}},
+	"RESET":       {summary: "Resets the connection.", arguments: []string{}},
+	"VERSION":     {summary: "Returns the server version.", arguments: []string{}},
+	"TIME":        {summary: "Returns the server time.", arguments: []string{}},
+	"DBSIZE":      {summary: "Returns the number of keys.", arguments: []string{}},
+	"RANDOMKEY":   {summary: "Returns a random key name.", arguments: []string{}},
+	"KEYSINFO":    {summary: "Returns the name, type and time to live of each key matching a pattern.", arguments: []string{"pattern", "[COUNT count]"}},
+	"SCAN":        {summary: "Iterates over the key names.", arguments: []string{"cursor", "[MATCH pattern]", "[COUNT count]"}},
+	"INFO":        {summary: "Returns information and statistics about the server.", arguments: []string{"[section]"}},
+	"COMMAND":     {summary: "A container for command introspection commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+	"OBJECT":      {summary: "A container for object introspection commands.", arguments: []string{"subcommand", "key"}},
+	"CLUSTER":     {summary: "A container for Redis Cluster commands; medis always runs without cluster mode.", arguments: []string{"subcommand"}},
+	"MEMORY":      {summary: "A container for memory diagnostics commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+	"DEBUG":       {summary: "A container for debugging commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+	"LATENCY":     {summary: "A container for latency diagnostics commands.", arguments: []string{"subcommand", "[arg [arg ...]]"}},
+}
+
+// errWrongNumArgs is the error for calling command, which may include a
+// subcommand, with the wrong number of arguments.
+func errWrongNumArgs(command string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", command)
+}
+
+// errUnknownSubcommand is the error for an unknown subcommand of command.
+func errUnknownSubcommand(command, subcommand string) error {
+	return fmt.Errorf("unknown subcommand '%s'. Try %s HELP.", subcommand, command)
+}
+
+// validArgs reports whether a call with n arguments, including the command
+// name, satisfies the command's arity.
+func (c commandInfo) validArgs(n int) bool {
+	return n >= c.minArgs && (c.maxArgs < 0 || n <= c.maxArgs)
+}
+
+// commandKeys returns the keys the command line args would access, without
+// running it.
+func commandKeys(args []string) ([]string, error) {
+	info, ok := commandTable[strings.ToUpper(args[0])]
+	if !ok {
+		return nil, errors.New("invalid command specified")
+	}
+	if !info.validArgs(len(args)) {
+		return nil, errors.New("invalid number of arguments specified for command")
+	}
+	spec := info.keys
+	if spec.keyCount > 0 {
+		numKeys, err := strconv.Atoi(args[spec.keyCount])
+		if err != nil || numKeys < 0 || spec.keyCount+numKeys >= len(args) {
+			return nil, errors.New("invalid arguments specified for command")
+		}
+		if numKeys == 0 {
+			return nil, errors.New("the command has no key arguments")
+		}
+		return args[spec.keyCount+1 : spec.keyCount+1+numKeys], nil
+	}
+	if spec.first == 0 {
+		return nil, errors.New("the command has no key arguments")
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := spec.first; i <= last; i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys, nil
+}
+
+// commandHelp holds the usage lines returned by "<command> HELP" for the
+// commands that take subcommands.
+var commandHelp = map[string][]string{
+	"CLUSTER": {
+		"CLUSTER <subcommand>. Subcommands are:",
+		"INFO",
+		"    Return information about the cluster, which is always disabled.",
+		"NODES",
+		"    Return cluster configuration seen by node; always empty.",
+		"SLOTS",
+		"    Return information about slots range mappings; always empty.",
+		"HELP",
+		"    Print this help.",
+	},
+	"OBJECT": {
+		"OBJECT <subcommand> [<arg> ...]. Subcommands are:",
+		"ENCODING <key>",
+		"    Return the kind of internal representation used to store the value of <key>.",
+		"FREQ <key>",
+		"    Return the number of times <key> has been read or written.",
+		"REFCOUNT <key>",
+		"    Return the number of references of the value associated with <key>.",
+		"HELP",
+		"    Print this help.",
+	},
+	"COMMAND": {
+		"COMMAND <subcommand> [<arg> ...]. Subcommands are:",
+		"COUNT",
+		"    Return the total number of commands in this server.",
+		"LIST",
+		"    Return a list of all commands in this server.",
+		"DOCS [<command-name> ...]",
+		"    Return documentary information about commands.",
+		"    (default: all commands)",
+		"GETKEYS <command> [<arg> ...]",
+		"    Return the keys from a full command.",
+		"HELP",
+		"    Print this help.",
+	},
+	"CLIENT": {
+		"CLIENT <subcommand> [<arg> ...]. Subcommands are:",
+		"ID",
+		"    Return the ID of the current connection.",
+		"KILL <ID client-id|ADDR ip:port>",
+		"    Kill connections by ID or address. Returns the number of connections killed.",
+		"LIST",
+		"    Return information about client connections.",
+		"HELP",
+		"    Print this help.",
+	},
+	"LATENCY": {
+		"LATENCY <subcommand> [<arg> ...]. Subcommands are:",
+		"HISTORY <event>",
+		"    Return time-latency samples for the <event> class.",
+		"LATEST",
+		"    Return the latest latency samples for all events.",
+		"RESET [<event> ...]",
+		"    Reset latency data of one or more <event> classes.",
+		"    (default: reset all data for all event classes)",
+		"HELP",
+		"    Print this help.",
+	},
+	"SCRIPT": {
+		"SCRIPT <subcommand> [<arg> ...]. Subcommands are:",
+		"EXISTS <sha1> [<sha1> ...]",
+		"    Return information about the existence of the scripts in the script cache.",
+		"FLUSH",
+		"    Flush the scripts cache.",
+		"LOAD <script>",
+		"    Load a script into the scripts cache without executing it.",
+		"HELP",
+		"    Print this help.",
+	},
+	"MEMORY": {
+		"MEMORY <subcommand> [<arg> ...]. Subcommands are:",
+		"DOCTOR",
+		"    Return the number of keys and the approximate bytes they use.",
+		"STATS",
+		"    Return information about the memory usage of the server.",
+		"USAGE <key> [SAMPLES <count>]",
+		"    Return memory in bytes used by <key> and its value.",
+		"HELP",
+		"    Print this help.",
+	},
+	"DEBUG": {
+		"DEBUG <subcommand> [<arg> ...]. Subcommands are:",
+		"CHANGE-REPL-ID",
+		"    Change the replication IDs of the instance.",
+		"ENCODING <key>",
+		"    Return the internal encoding of the value of <key>.",
+		"OBJECT <key>",
+		"    Show low-level info about <key> and its value.",
+		"STRINGMATCH-LEN <pattern> <string>",
+		"    Return 1 if <string> matches the glob-style <pattern>, as used by SCAN MATCH and KEYSINFO.",
+		"SET-ACTIVE-EXPIRE <0|1>",
+		"    Setting it to 0 disables expiring keys in background when they are not accessed.",
+		"HELP",
+		"    Print this help.",
+	},
+}
+
+// infoSections lists the sections reported by a plain INFO, in order.
+var infoSections = []string{"server", "memory", "stats", "replication"}
+
+// infoLines renders the named INFO section, or every section for "default"
+// and "all", as "# Title" headers followed by "field:value" lines.
+func infoLines(mr *MiniRedis, section string) []string {
+	if section == "default" || section == "all" {
+		sections := infoSections
+		// As in Redis, only "all" includes the per-command stats.
+		if section == "all" {
+			sections = append(append([]string{}, infoSections...), "commandstats")
+		}
+		var lines []string
+		for i, name := range sections {
+			if i > 0 {
+				lines = append(lines, "")
+			}
+			lines = append(lines, infoLines(mr, name)...)
+		}
+		return lines
+	}
+
+	stats := mr.Stats()
+	switch section {
+	case "server":
+		return []string{
+			"# Server",
+			"medis_version:" + version,
+			"process_id:" + strconv.Itoa(os.Getpid()),
+			"run_id:" + runID,
+			"uptime_in_seconds:" + strconv.FormatInt(int64(time.Since(startTime).Seconds()), 10),
+		}
+	case "memory":
+		return []string{
+			"# Memory",
+			"used_memory:" + strconv.FormatInt(stats.UsedMemory, 10),
+		}
+	case "stats":
+		return []string{
+			"# Stats",
+			"expired_keys:" + strconv.FormatInt(stats.ExpiredKeys, 10),
+			"evicted_keys:" + strconv.FormatInt(stats.EvictedKeys, 10),
+		}
+	case "commandstats":
+		return append([]string{"# Commandstats"}, mr.commandStats.infoLines()...)
+	case "replication":
+		replID, replOffset := mr.Replication()
+		// There are no replicas; this is what a Redis master without any
+		// reports.
+		return []string{
+			"# Replication",
+			"role:master",
+			"connected_slaves:0",
+			"master_replid:" + replID,
+			"master_repl_offset:" + strconv.FormatInt(replOffset, 10),
+		}
+	}
+	return nil
+}
+
+// writeArray replies with a multi-line array of bulk strings: a "*<count>"
+// header followed by one "$<item>" line per element.
+func writeArray(w io.Writer, items []string) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(items)) + "\n")
+	for _, item := range items {
+		b.WriteString("$" + item + "\n")
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// writeCommandDocs replies to COMMAND DOCS with the docs of the named
+// commands, skipping unknown ones. Without RESP3 maps the reply is a flat
+// array alternating command names and their docs, which in turn alternate
+// field names and values, as Redis replies to RESP2 clients.
+func writeCommandDocs(w io.Writer, names []string) {
+	var b strings.Builder
+	n := 0
+	for _, name := range names {
+		info, ok := commandTable[strings.ToUpper(name)]
+		if !ok {
+			continue
+		}
+		doc := commandDocs[strings.ToUpper(name)]
+		// Like Redis, a negative arity means at least that many arguments.
+		arity := info.minArgs
+		if info.maxArgs != info.minArgs {
+			arity = -arity
+		}
+		b.WriteString("$" + strings.ToLower(name) + "\n*6\n")
+		b.WriteString("$summary\n$" + doc.summary + "\n")
+		b.WriteString("$arity\n:" + strconv.Itoa(arity) + "\n")
+		b.WriteString("$arguments\n*" + strconv.Itoa(len(doc.arguments)) + "\n")
+		for _, arg := range doc.arguments {
+			b.WriteString("$" + arg + "\n")
+		}
+		n++
+	}
+	_, _ = w.Write([]byte("*" + strconv.Itoa(2*n) + "\n" + b.String()))
+}
+
+// writeIntArray replies with an array of integers, one ":<n>" line each.
+func writeIntArray(w io.Writer, items []int64) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(items)) + "\n")
+	for _, item := range items {
+		b.WriteString(":" + strconv.FormatInt(item, 10) + "\n")
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// splitArgs splits an inline command line into arguments the way Redis does:
+// on whitespace, except inside "double quotes", which understand \n, \r, \t,
+// \b, \a, \\, \" and \xHH escapes, or 'single quotes', which only understand
+// \'. A closing quote must be followed by whitespace or the end of the line.
+// Every reply ends at a newline, with no length to say otherwise, so an
+// argument that unescapes to a CR or LF is rejected rather than stored.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		for i < len(line) && !isSpace(line[i]) {
+			quote := line[i]
+			if quote != '"' && quote != '\'' {
+				arg = append(arg, quote)
+				i++
+				continue
+			}
+			i++
+			for {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == quote {
+					i++
+					if i < len(line) && !isSpace(line[i]) {
+						return nil, errUnbalancedQuotes
+					}
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					next := line[i+1]
+					switch {
+					case quote == '\'':
+						if next == '\'' {
+							c = next
+							i++
+						}
+					case next == 'x' && i+3 < len(line) && isHexByte(line[i+2:i+4]):
+						b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+						c = byte(b)
+						i += 3
+					default:
+						c = unescape(next)
+						i++
+					}
+				}
+				arg = append(arg, c)
+				i++
+			}
+		}
+		if bytes.ContainsAny(arg, "\r\n") {
+			return nil, errNewlineInArg
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isHexByte(s string) bool {
+	_, err := strconv.ParseUint(s, 16, 8)
+	return err == nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == 0
+}
+
+// unescape maps the character after a backslash in a double-quoted string
+// to the byte it stands for.
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
+
+// readInline reads one newline-terminated command line. It fails with
+// errInlineTooBig as soon as the line grows past maxInlineLen, so a client
+// can't make the server buffer an unbounded line.
+func readInline(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(bytes.TrimRight(line, "\r\n")) > maxInlineLen {
+			return "", errInlineTooBig
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return string(line), err
+		}
+	}
+}
+
+func setKeepAlive(conn *net.TCPConn) {
+	if tcpKeepAlive <= 0 {
+		_ = conn.SetKeepAlive(false)
+		return
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		logf(levelWarn, "Error enabling keepalive for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetKeepAlivePeriod(tcpKeepAlive)
+}
+
+// client is a connection registered in clients for as long as it's served.
+type client struct {
+	id      uint64
+	conn    net.Conn
+	created time.Time
+}
+
+// clientRegistry tracks the connected clients so CLIENT can list and kill
+// them.
+type clientRegistry struct {
+	mu      sync.Mutex
+	lastID  uint64
+	clients map[uint64]*client
+}
+
+var clients = clientRegistry{clients: make(map[uint64]*client)}
+
+// register assigns conn the next client ID.
+func (r *clientRegistry) register(conn net.Conn) *client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	c := &client{id: r.lastID, conn: conn, created: time.Now()}
+	r.clients[c.id] = c
+	return c
+}
+
+func (r *clientRegistry) unregister(c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c.id)
+}
+
+// list describes every client, in ID order, the way CLIENT LIST does.
+func (r *clientRegistry) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]uint64, 0, len(r.clients))
+	for id := range r.clients {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		c := r.clients[id]
+		lines[i] = fmt.Sprintf("id=%d addr=%s laddr=%s age=%d",
+			c.id, c.conn.RemoteAddr(), c.conn.LocalAddr(), int64(time.Since(c.created).Seconds()))
+	}
+	return lines
+}
+
+// kill closes the connection of every client match selects, which makes
+// its handleRequest return. The caller's own connection, self, is left
+// open so it can still be sent a reply; kill reports whether self was
+// selected. It returns the number of clients selected.
+func (r *clientRegistry) kill(self *client, match func(*client) bool) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	killed, killedSelf := 0, false
+	for _, c := range r.clients {
+		if !match(c) {
+			continue
+		}
+		killed++
+		if c == self {
+			killedSelf = true
+		} else {
+			_ = c.conn.Close()
+		}
+	}
+	return killed, killedSelf
+}
+
+// tokenBucket allows rate events per second on average, in bursts of up to
+// rate events.
+type tokenBucket struct {
+	rate, tokens float64
+	last         time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// allow takes a token if one is left, refilling for the time since the
+// last call first.
+func (b *tokenBucket) allow() bool {
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func handleRequest(c *client, mr *MiniRedis) {
+	conn := c.conn
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	var limiter *tokenBucket
+	if clientRateLimit > 0 {
+		limiter = newTokenBucket(float64(clientRateLimit))
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		cmdLine, err := readInline(reader)
+		if errors.Is(err, errInlineTooBig) {
+			logf(levelWarn, "Closing connection from %s: %v", conn.RemoteAddr(), err)
+			writeError(conn, err)
+			return
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				logf(levelDebug, "Connection closed by %s", conn.RemoteAddr())
+			} else {
+				logf(levelWarn, "Error reading command: %v", err)
+			}
+			return
+		}
+		cmdParts, err := splitArgs(cmdLine)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		if len(cmdParts) == 0 {
+			continue
+		}
+		logf(levelDebug, "cmd: %v", cmdParts)
+		if limiter != nil && !limiter.allow() {
+			writeError(conn, errRateLimit)
+			continue
+		}
+
+		// The delay comes before taking the command lock so that only this
+		// client waits.
+		if d, ok := injectedLatency[strings.ToUpper(cmdParts[0])]; ok {
+			time.Sleep(d)
+		}
+
+		// Replies are buffered so the command lock is never held while
+		// writing to a slow client.
+		var reply bytes.Buffer
+		info := commandTable[strings.ToUpper(cmdParts[0])]
+		if info.exclusive {
+			commandMu.Lock()
+		} else {
+			commandMu.RLock()
+		}
+		start := time.Now()
+		closeConn := execCommand(&reply, mr, c, cmdParts)
+		mr.latency.add("command", time.Since(start))
+		if info.exclusive {
+			commandMu.Unlock()
+		} else {
+			commandMu.RUnlock()
+		}
+		_, _ = conn.Write(reply.Bytes())
+		if closeConn {
+			return
+		}
+	}
+}
+
+// execCommand runs one command line for client c and writes its reply to w.
+// It reports whether the connection should be closed afterwards. Scripts
+// pass a nil client, so commands that need one are marked noScript.
+func execCommand(w io.Writer, mr *MiniRedis, c *client, cmdParts []string) bool {
+	action := strings.ToUpper(cmdParts[0])
+	if help, ok := commandHelp[action]; ok && len(cmdParts) == 2 && strings.ToUpper(cmdParts[1]) == "HELP" {
+		writeArray(w, help)
+		return false
+	}
+	info, ok := commandTable[action]
+	if !ok {
+		writeError(w, errUnknownCommand)
+		return false
+	}
+	if !info.validArgs(len(cmdParts)) {
+		writeError(w, errWrongNumArgs(action))
+		return false
+	}
+	if info.denyOOM {
+		if err := mr.FreeMemory(); err != nil {
+			writeError(w, err)
+			return false
+		}
+	}
+	start := time.Now()
+	defer func() {
+		mr.commandStats.add(action, time.Since(start))
+	}()
+	switch action {
+	case "SET":
+		opts, err := parseSetOptions(cmdParts[3:])
+		if err != nil {
+			writeError(w, err)
+			return false
+		}
+		switch {
+		case opts.keepTTL:
+			mr.SetKeepTTL(cmdParts[1], cmdParts[2])
+		case opts.expires != nil && *opts.expires <= 0:
+			// Like Redis, an EXAT or PXAT time that has passed deletes the key.
+			mr.Delete(cmdParts[1])
+		default:
+			mr.Set(cmdParts[1], cmdParts[2], opts.expires)
+		}
+		mr.propagate(cmdParts)
+		_, _ = w.Write([]byte("OK\n"))
+	case "GET":
+		value, ok := mr.Get(cmdParts[1])
+		if !ok {
+			_, _ = w.Write([]byte("$-1\n"))
+			return false
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf("$%s\n", value)))
+	case "GETWITHTTL":
+		value, ttl, ok := mr.GetWithTTL(cmdParts[1])
+		reply := "*2\n$-1\n"
+		if ok {
+			reply = "*2\n$" + value + "\n"
+		}
+		_, _ = w.Write([]byte(reply + ":" + strconv.FormatInt(ttl, 10) + "\n"))
+	case "DEL":
+		deleted := mr.Delete(cmdParts[1:]...)
+		if deleted > 0 {
+			mr.propagate(cmdParts)
+		}
+		_, _ = w.Write([]byte(":" + strconv.Itoa(deleted) + "\n"))
+	case "TTL":
+		ttl, ok := mr.TTL(cmdParts[1])
+		if !ok {
+			_, _ = w.Write([]byte("-2\n"))
+			return false
+		}
+		_, _ = w.Write([]byte(strconv.FormatInt(ttl, 10) + "\n"))
+	case "CLIENT":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "ID":
+			_, _ = w.Write([]byte(":" + strconv.FormatUint(c.id, 10) + "\n"))
+		case "LIST":
+			writeArray(w, clients.list())
+		case "KILL":
+			if len(cmdParts) != 4 {
+				writeError(w, errWrongNumArgs("CLIENT KILL"))
+				return false
+			}
+			var match func(*client) bool
+			switch strings.ToUpper(cmdParts[2]) {
+			case "ID":
+				id, err := strconv.ParseUint(cmdParts[3], 10, 64)
+				if err != nil {
+					writeError(w, errors.New("client-id should be greater than 0"))
+					return false
+				}
+				match = func(other *client) bool { return other.id == id }
+			case "ADDR":
+				match = func(other *client) bool { return other.conn.RemoteAddr().String() == cmdParts[3] }
+			default:
+				writeError(w, errSyntax)
+				return false
+			}
+			killed, killedSelf := clients.kill(c, match)
+			_, _ = w.Write([]byte(":" + strconv.Itoa(killed) + "\n"))
+			return killedSelf
+		default:
+			writeError(w, errUnknownSubcommand("CLIENT", cmdParts[1]))
+		}
+	case "SHUTDOWN":
+		if len(cmdParts) == 2 {
+			switch strings.ToUpper(cmdParts[1]) {
+			case "NOSAVE":
+			case "SAVE":
+				// There is no persistence, so there is nowhere to save to.
+				writeError(w, errors.New("Errors trying to SHUTDOWN: saving is not supported"))
+				return false
+			default:
+				writeError(w, errSyntax)
+				return false
+			}
+		}
+		// Like Redis, a successful SHUTDOWN never replies.
+		select {
+		case shutdownRequests <- struct{}{}:
+		default:
+		}
+		return true
+	case "QUIT":
+		_, _ = w.Write([]byte("OK\n"))
+		return true
+	case "RESET":
+		// Connections carry no state yet (no SELECT, MULTI, AUTH or
+		// client names), so there is nothing to clear before replying.
+		_, _ = w.Write([]byte("RESET\n"))
+	case "MTTL":
+		writeIntArray(w, mr.MTTL(cmdParts[1:]))
+	case "INCRBYFLOAT":
+		incr, err := strconv.ParseFloat(cmdParts[2], 64)
+		if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+			writeError(w, errNotFloat)
+			return false
+		}
+		value, err := mr.IncrByFloat(cmdParts[1], incr)
+		if err != nil {
+			writeError(w, err)
+			return false
+		}
+		mr.propagate(cmdParts)
+		_, _ = w.Write([]byte(fmt.Sprintf("$%s\n", formatFloat(value))))
+	case "MEXPIRE":
+		ttl, err := parseExpireTime(cmdParts[1], time.Second)
+		if err != nil {
+			writeError(w, err)
+			return false
+		}
+		updated := mr.MExpire(cmdParts[2:], ttl)
+		if updated > 0 {
+			mr.propagate(cmdParts)
+		}
+		_, _ = w.Write([]byte(":" + strconv.Itoa(updated) + "\n"))
+	case "CAS":
+		if mr.CompareAndSet(cmdParts[1], cmdParts[2], cmdParts[3]) {
+			mr.propagate(cmdParts)
+			_, _ = w.Write([]byte(":1\n"))
+		} else {
+			_, _ = w.Write([]byte(":0\n"))
+		}
+	case "CLUSTER":
+		// Cluster-aware clients probe these on connect; reporting cluster
+		// mode as disabled lets them fall back to a single node.
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "INFO":
+			writeArray(w, []string{
+				"cluster_enabled:0",
+				"cluster_state:ok",
+				"cluster_slots_assigned:0",
+				"cluster_slots_ok:0",
+				"cluster_slots_pfail:0",
+				"cluster_slots_fail:0",
+				"cluster_known_nodes:1",
+				"cluster_size:0",
+				"cluster_current_epoch:0",
+				"cluster_my_epoch:0",
+			})
+		case "NODES":
+			_, _ = w.Write([]byte("$\n"))
+		case "SLOTS":
+			writeArray(w, nil)
+		default:
+			writeError(w, errUnknownSubcommand("CLUSTER", cmdParts[1]))
+		}
+	case "OBJECT":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "FREQ":
+			freq, ok := mr.AccessCount(cmdParts[2])
+			if !ok {
+				_, _ = w.Write([]byte("$-1\n"))
+				return false
+			}
+			_, _ = w.Write([]byte(":" + strconv.FormatInt(freq, 10) + "\n"))
+		case "REFCOUNT":
+			if _, ok := mr.AccessCount(cmdParts[2]); !ok {
+				_, _ = w.Write([]byte("$-1\n"))
+				return false
+			}
+			_, _ = w.Write([]byte(":1\n"))
+		case "ENCODING":
+			encoding, ok := mr.Encoding(cmdParts[2])
+			if !ok {
+				_, _ = w.Write([]byte("$-1\n"))
+				return false
+			}
+			_, _ = w.Write([]byte("$" + encoding + "\n"))
+		default:
+			writeError(w, errUnknownSubcommand("OBJECT", cmdParts[1]))
+		}
+	case "VERSION":
+		_, _ = w.Write([]byte("$" + version + "\n"))
+	case "TIME":
+		now := time.Now()
+		writeArray(w, []string{
+			strconv.FormatInt(now.Unix(), 10),
+			strconv.Itoa(now.Nanosecond() / 1000),
+		})
+	case "DBSIZE":
+		_, _ = w.Write([]byte(":" + strconv.Itoa(mr.Stats().Keys) + "\n"))
+	case "SCAN":
+		cursor, err := strconv.ParseUint(cmdParts[1], 10, 64)
+		if err != nil {
+			writeError(w, errors.New("invalid cursor"))
+			return false
+		}
+		pattern, count := "", 10
+		for i := 2; i < len(cmdParts); i += 2 {
+			if i+1 == len(cmdParts) {
+				writeError(w, errSyntax)
+				return false
+			}
+			switch strings.ToUpper(cmdParts[i]) {
+			case "MATCH":
+				pattern = cmdParts[i+1]
+			case "COUNT":
+				n, err := strconv.Atoi(cmdParts[i+1])
+				if err != nil || n < 1 {
+					writeError(w, errNotInteger)
+					return false
+				}
+				count = n
+			default:
+				writeError(w, errSyntax)
+				return false
+			}
+		}
+		next, keys := mr.Scan(cursor, pattern, count)
+		// The reply nests the key array after the next cursor.
+		_, _ = w.Write([]byte("*2\n$" + strconv.FormatUint(next, 10) + "\n"))
+		writeArray(w, keys)
+	case "RANDOMKEY":
+		key, ok := mr.RandomKey()
+		if !ok {
+			_, _ = w.Write([]byte("$-1\n"))
+			return false
+		}
+		_, _ = w.Write([]byte("$" + key + "\n"))
+	case "KEYSINFO":
+		count := 0
+		if len(cmdParts) > 2 {
+			if len(cmdParts) != 4 || strings.ToUpper(cmdParts[2]) != "COUNT" {
+				writeError(w, errSyntax)
+				return false
+			}
+			n, err := strconv.Atoi(cmdParts[3])
+			if err != nil || n < 1 {
+				writeError(w, errNotInteger)
+				return false
+			}
+			count = n
+		}
+		infos := mr.KeysInfo(cmdParts[1], count)
+		// Each key is a nested array of its name, type and TTL.
+		var b strings.Builder
+		b.WriteString("*" + strconv.Itoa(len(infos)) + "\n")
+		for _, info := range infos {
+			b.WriteString("*3\n$" + info.Key + "\n$" + info.Type + "\n:" + strconv.FormatInt(info.TTL, 10) + "\n")
+		}
+		_, _ = w.Write([]byte(b.String()))
+	case "EVAL", "EVALSHA":
+		src := cmdParts[1]
+		if action == "EVALSHA" {
+			var ok bool
+			if src, ok = mr.Script(cmdParts[1]); !ok {
+				writeError(w, errNoScript)
+				return false
+			}
+		}
+		numKeys, err := strconv.Atoi(cmdParts[2])
+		switch {
+		case err != nil:
+			writeError(w, errNotInteger)
+			return false
+		case numKeys < 0:
+			writeError(w, errors.New("Number of keys can't be negative"))
+			return false
+		case numKeys > len(cmdParts)-3:
+			writeError(w, errors.New("Number of keys can't be greater than number of args"))
+			return false
+		}
+		sc, err := parseScript(src)
+		if err != nil {
+			writeError(w, fmt.Errorf("Error compiling script: %w", err))
+			return false
+		}
+		if action == "EVAL" {
+			mr.LoadScript(src)
+		}
+		sc.run(w, mr, cmdParts[3:3+numKeys], cmdParts[3+numKeys:])
+	case "REGISTER":
+		p, err := parseProcedure(cmdParts[2])
+		if err != nil {
+			writeError(w, fmt.Errorf("Error compiling procedure: %w", err))
+			return false
+		}
+		mr.Register(cmdParts[1], p)
+		_, _ = w.Write([]byte("OK\n"))
+	case "CALL":
+		p, ok := mr.Procedure(cmdParts[1])
+		if !ok {
+			writeError(w, errors.New("No such procedure"))
+			return false
+		}
+		if len(cmdParts)-2 != p.numArgs {
+			writeError(w, fmt.Errorf("procedure '%s' takes %d arguments", cmdParts[1], p.numArgs))
+			return false
+		}
+		p.run(w, mr, cmdParts[2:])
+	case "SCRIPT":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "LOAD":
+			if len(cmdParts) != 3 {
+				writeError(w, errWrongNumArgs("SCRIPT LOAD"))
+				return false
+			}
+			if _, err := parseScript(cmdParts[2]); err != nil {
+				writeError(w, fmt.Errorf("Error compiling script: %w", err))
+				return false
+			}
+			_, _ = w.Write([]byte("$" + mr.LoadScript(cmdParts[2]) + "\n"))
+		case "EXISTS":
+			if len(cmdParts) < 3 {
+				writeError(w, errWrongNumArgs("SCRIPT EXISTS"))
+				return false
+			}
+			exists := make([]int64, len(cmdParts)-2)
+			for i, sha := range cmdParts[2:] {
+				if _, ok := mr.Script(sha); ok {
+					exists[i] = 1
+				}
+			}
+			writeIntArray(w, exists)
+		case "FLUSH":
+			mr.FlushScripts()
+			_, _ = w.Write([]byte("OK\n"))
+		default:
+			writeError(w, errUnknownSubcommand("SCRIPT", cmdParts[1]))
+		}
+	case "INFO":
+		section := "default"
+		if len(cmdParts) == 2 {
+			section = strings.ToLower(cmdParts[1])
+		}
+		writeArray(w, infoLines(mr, section))
+	case "COMMAND":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "COUNT":
+			_, _ = w.Write([]byte(":" + strconv.Itoa(len(commandTable)) + "\n"))
+		case "LIST":
+			names := make([]string, 0, len(commandTable))
+			for name := range commandTable {
+				names = append(names, strings.ToLower(name))
+			}
+			sort.Strings(names)
+			writeArray(w, names)
+		case "GETKEYS":
+			if len(cmdParts) < 3 {
+				writeError(w, errWrongNumArgs("COMMAND GETKEYS"))
+				return false
+			}
+			keys, err := commandKeys(cmdParts[2:])
+			if err != nil {
+				writeError(w, err)
+				return false
+			}
+			writeArray(w, keys)
+		case "DOCS":
+			names := cmdParts[2:]
+			if len(names) == 0 {
+				for name := range commandTable {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+			}
+			writeCommandDocs(w, names)
+		default:
+			writeError(w, errUnknownSubcommand("COMMAND", cmdParts[1]))
+		}
+	case "MEMORY":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "USAGE":
+			if len(cmdParts) != 3 && len(cmdParts) != 5 {
+				writeError(w, errWrongNumArgs("MEMORY USAGE"))
+				return false
+			}
+			// Strings are measured exactly, so SAMPLES is validated but unused.
+			if len(cmdParts) == 5 {
+				samples, err := strconv.Atoi(cmdParts[4])
+				if strings.ToUpper(cmdParts[3]) != "SAMPLES" || err != nil || samples < 0 {
+					writeError(w, errSyntax)
+					return false
+				}
+			}
+			usage, ok := mr.MemoryUsage(cmdParts[2])
+			if !ok {
+				_, _ = w.Write([]byte("$-1\n"))
+				return false
+			}
+			_, _ = w.Write([]byte(":" + strconv.FormatInt(usage, 10) + "\n"))
+		case "DOCTOR":
+			stats := mr.Stats()
+			_, _ = w.Write([]byte(fmt.Sprintf("$%d keys using approximately %d bytes (key + value + %d bytes overhead per key)\n",
+				stats.Keys, stats.UsedMemory, entryOverhead)))
+		case "STATS":
+			stats := mr.Stats()
+			writeArray(w, []string{
+				"keys.count", strconv.Itoa(stats.Keys),
+				"dataset.bytes", strconv.FormatInt(stats.UsedMemory, 10),
+				"expired.keys", strconv.FormatInt(stats.ExpiredKeys, 10),
+				"evicted.keys", strconv.FormatInt(stats.EvictedKeys, 10),
+			})
+		default:
+			writeError(w, errUnknownSubcommand("MEMORY", cmdParts[1]))
+		}
+	case "LATENCY":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "LATEST":
+			if len(cmdParts) != 2 {
+				writeError(w, errWrongNumArgs("LATENCY LATEST"))
+				return false
+			}
+			latest := mr.latency.latest()
+			// Each event is a nested array of its name, the time and latency
+			// of its latest sample, and its maximum latency.
+			var b strings.Builder
+			b.WriteString("*" + strconv.Itoa(len(latest)) + "\n")
+			for _, l := range latest {
+				b.WriteString(fmt.Sprintf("*4\n$%s\n:%d\n:%d\n:%d\n", l.event, l.time, l.latency, l.max))
+			}
+			_, _ = w.Write([]byte(b.String()))
+		case "HISTORY":
+			if len(cmdParts) != 3 {
+				writeError(w, errWrongNumArgs("LATENCY HISTORY"))
+				return false
+			}
+			history := mr.latency.history(cmdParts[2])
+			var b strings.Builder
+			b.WriteString("*" + strconv.Itoa(len(history)) + "\n")
+			for _, sample := range history {
+				b.WriteString(fmt.Sprintf("*2\n:%d\n:%d\n", sample.time, sample.latency))
+			}
+			_, _ = w.Write([]byte(b.String()))
+		case "RESET":
+			_, _ = w.Write([]byte(":" + strconv.Itoa(mr.latency.reset(cmdParts[2:]...)) + "\n"))
+		default:
+			writeError(w, errUnknownSubcommand("LATENCY", cmdParts[1]))
+		}
+	case "DEBUG":
+		subcommand := strings.ToUpper(cmdParts[1])
+		switch subcommand {
+		case "OBJECT":
+			if len(cmdParts) != 3 {
+				writeError(w, errWrongNumArgs("DEBUG OBJECT"))
+				return false
+			}
+			v, ok := mr.Object(cmdParts[2])
+			if !ok {
+				writeError(w, errNoSuchKey)
+				return false
+			}
+			// Values are stored and would be serialized as their raw bytes.
+			_, _ = w.Write([]byte(fmt.Sprintf("Value refcount:1 encoding:%s serializedlength:%d\n", v.encoding(), len(v.value))))
+		case "ENCODING":
+			if len(cmdParts) != 3 {
+				writeError(w, errWrongNumArgs("DEBUG ENCODING"))
+				return false
+			}
+			encoding, ok := mr.Encoding(cmdParts[2])
+			if !ok {
+				writeError(w, errNoSuchKey)
+				return false
+			}
+			_, _ = w.Write([]byte("$" + encoding + "\n"))
+		case "SET-ACTIVE-EXPIRE":
+			if len(cmdParts) != 3 {
+				writeError(w, errWrongNumArgs("DEBUG SET-ACTIVE-EXPIRE"))
+				return false
+			}
+			switch cmdParts[2] {
+			case "0", "1":
+				mr.SetActiveExpire(cmdParts[2] == "1")
+				_, _ = w.Write([]byte("OK\n"))
+			default:
+				writeError(w, errSyntax)
+			}
+		case "STRINGMATCH-LEN":
+			if len(cmdParts) != 4 {
+				writeError(w, errWrongNumArgs("DEBUG STRINGMATCH-LEN"))
+				return false
+			}
+			if stringMatch(cmdParts[2], cmdParts[3]) {
+				_, _ = w.Write([]byte(":1\n"))
+			} else {
+				_, _ = w.Write([]byte(":0\n"))
+			}
+		case "CHANGE-REPL-ID":
+			if len(cmdParts) != 2 {
+				writeError(w, errWrongNumArgs("DEBUG CHANGE-REPL-ID"))
+				return false
+			}
+			mr.ChangeReplID()
+			_, _ = w.Write([]byte("OK\n"))
+		default:
+			writeError(w, errUnknownSubcommand("DEBUG", cmdParts[1]))
+		}
+	default:
+		writeError(w, errUnknownCommand)
+	}
+	return false
+}
+
+// A script is a parsed EVAL script. medis runs a small subset of Lua: a
+// sequence of redis.call(...) and redis.pcall(...) statements, optionally
+// separated by semicolons, ending in an optional return statement. Call
+// arguments are string or integer literals, KEYS[n] or ARGV[n]. A return
+// statement may also return nil or a call, whose reply becomes the script's
+// reply. Comments start with "--".
+type script struct {
+	stmts []scriptStmt
+}
+
+type scriptStmt struct {
+	isReturn bool
+	// expr is nil for a bare "return".
+	expr *scriptExpr
+}
+
+type exprKind int
+
+const (
+	exprNil exprKind = iota
+	exprString
+	exprNumber
+	exprKeys
+	exprArgv
+	exprCall
+)
+
+type scriptExpr struct {
+	kind exprKind
+	// text is the value of a string or number literal.
+	text string
+	// index is the 1-based index of KEYS[n] or ARGV[n].
+	index int
+	// pcall marks a protected call, whose errors become its result instead
+	// of stopping the script.
+	pcall bool
+	args  []scriptExpr
+}
+
+// scriptToken kinds are 'i' for identifiers, 's' for strings, 'n' for
+// numbers and 0 for the end of the script; punctuation is its own kind.
+type scriptToken struct {
+	kind byte
+	text string
+}
+
+func tokenizeScript(src string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpace(c):
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("()[],;", c) >= 0:
+			tokens = append(tokens, scriptToken{kind: c, text: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			var text []byte
+			for i++; ; i++ {
+				if i == len(src) || src[i] == '\n' {
+					return nil, errors.New("unfinished string")
+				}
+				if src[i] == c {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					// Like command arguments, strings can't hold a line break.
+					b := unescape(src[i])
+					if b == '\r' || b == '\n' {
+						return nil, errors.New("strings can't contain CR or LF")
+					}
+					text = append(text, b)
+					continue
+				}
+				text = append(text, src[i])
+			}
+			tokens = append(tokens, scriptToken{kind: 's', text: string(text)})
+		case c == '-' || isDigit(c):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			if j == i+1 && c == '-' {
+				return nil, errors.New("unexpected symbol near '-'")
+			}
+			tokens = append(tokens, scriptToken{kind: 'n', text: src[i:j]})
+			i = j
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, scriptToken{kind: 'i', text: src[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected symbol near '%c'", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+}
+
+func (p *scriptParser) peek() scriptToken {
+	if p.pos == len(p.tokens) {
+		return scriptToken{text: "<eof>"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() scriptToken {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scriptParser) expect(kind byte) error {
+	if t := p.next(); t.kind != kind {
+		return fmt.Errorf("'%c' expected near '%s'", kind, t.text)
+	}
+	return nil
+}
+
+func parseScript(src string) (*script, error) {
+	tokens, err := tokenizeScript(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	sc := &script{}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == 0:
+			return sc, nil
+		case t.kind == ';':
+			p.next()
+		case t.kind == 'i' && t.text == "return":
+			p.next()
+			stmt := scriptStmt{isReturn: true}
+			if kind := p.peek().kind; kind != 0 && kind != ';' {
+				expr, err := p.parseExpr(true)
+				if err != nil {
+					return nil, err
+				}
+				stmt.expr = &expr
+			}
+			sc.stmts = append(sc.stmts, stmt)
+			for p.peek().kind == ';' {
+				p.next()
+			}
+			if t := p.peek(); t.kind != 0 {
+				return nil, fmt.Errorf("'<eof>' expected near '%s'", t.text)
+			}
+			return sc, nil
+		default:
+			expr, err := p.parseExpr(true)
+			if err != nil {
+				return nil, err
+			}
+			if expr.kind != exprCall {
+				return nil, fmt.Errorf("syntax error near '%s'", t.text)
+			}
+			sc.stmts = append(sc.stmts, scriptStmt{expr: &expr})
+		}
+	}
+}
+
+// parseExpr parses one expression. Calls are only allowed where allowCall
+// is set: their replies can be returned but not passed to another call.
+func (p *scriptParser) parseExpr(allowCall bool) (scriptExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return scriptExpr{kind: exprString, text: t.text}, nil
+	case 'n':
+		return scriptExpr{kind: exprNumber, text: t.text}, nil
+	case 'i':
+		switch t.text {
+		case "nil":
+			return scriptExpr{kind: exprNil}, nil
+		case "KEYS", "ARGV":
+			expr := scriptExpr{kind: exprKeys}
+			if t.text == "ARGV" {
+				expr.kind = exprArgv
+			}
+			if err := p.expect('['); err != nil {
+				return expr, err
+			}
+			index := p.next()
+			n, err := strconv.Atoi(index.text)
+			if index.kind != 'n' || err != nil {
+				return expr, fmt.Errorf("%s must be indexed by an integer near '%s'", t.text, index.text)
+			}
+			expr.index = n
+			return expr, p.expect(']')
+		case "redis.call", "redis.pcall":
+			expr := scriptExpr{kind: exprCall, pcall: t.text == "redis.pcall"}
+			if !allowCall {
+				return expr, fmt.Errorf("the reply of %s can't be used as an argument", t.text)
+			}
+			if err := p.expect('('); err != nil {
+				return expr, err
+			}
+			if p.peek().kind == ')' {
+				return expr, errors.New("please specify at least one argument for this redis lib call")
+			}
+			for {
+				arg, err := p.parseExpr(false)
+				if err != nil {
+					return expr, err
+				}
+				expr.args = append(expr.args, arg)
+				if p.peek().kind != ',' {
+					break
+				}
+				p.next()
+			}
+			return expr, p.expect(')')
+		}
+	}
+	return scriptExpr{}, fmt.Errorf("unexpected symbol near '%s'", t.text)
+}
+
+// run executes the script and writes its reply to w.
+func (sc *script) run(w io.Writer, mr *MiniRedis, keys, argv []string) {
+	for _, stmt := range sc.stmts {
+		reply := "$-1\n"
+		if stmt.expr != nil {
+			var ok bool
+			if reply, ok = stmt.expr.eval(mr, keys, argv); !ok {
+				_, _ = w.Write([]byte(reply))
+				return
+			}
+		}
+		if stmt.isReturn {
+			_, _ = w.Write([]byte(reply))
+			return
+		}
+	}
+	_, _ = w.Write([]byte("$-1\n"))
+}
+
+// eval evaluates e to a complete reply. It reports false, with an error
+// reply, when the script must stop.
+func (e scriptExpr) eval(mr *MiniRedis, keys, argv []string) (string, bool) {
+	if e.kind != exprCall {
+		value, ok := e.value(keys, argv)
+		switch {
+		case !ok:
+			return "$-1\n", true
+		case e.kind == exprNumber:
+			return ":" + value + "\n", true
+		}
+		return "$" + value + "\n", true
+	}
+
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		value, ok := arg.value(keys, argv)
+		if !ok {
+			return errorReply(errors.New("Lua redis lib command arguments must be strings or integers")), false
+		}
+		args[i] = value
+	}
+	info, ok := commandTable[strings.ToUpper(args[0])]
+	if !ok {
+		return errorReply(errors.New("Unknown Redis command called from script")), false
+	}
+	if info.noScript {
+		return errorReply(errors.New("This Redis command is not allowed from script")), false
+	}
+	var reply bytes.Buffer
+	execCommand(&reply, mr, nil, args)
+	if isErrorReply(reply.String()) && !e.pcall {
+		return reply.String(), false
+	}
+	return reply.String(), true
+}
+
+// value returns the string a literal, KEYS[n] or ARGV[n] stands for. It
+// reports false for nil and for indexes past the end of KEYS or ARGV.
+func (e scriptExpr) value(keys, argv []string) (string, bool) {
+	switch e.kind {
+	case exprString, exprNumber:
+		return e.text, true
+	case exprKeys:
+		if e.index >= 1 && e.index <= len(keys) {
+			return keys[e.index-1], true
+		}
+	case exprArgv:
+		if e.index >= 1 && e.index <= len(argv) {
+			return argv[e.index-1], true
+		}
+	}
+	return "", false
+}
+
+// isErrorReply reports whether reply is an error such as "-ERR ..." rather
+// than a negative integer like TTL's "-2".
+func isErrorReply(reply string) bool {
+	return len(reply) > 1 && reply[0] == '-' && reply[1] >= 'A' && reply[1] <= 'Z'
+}
+
+// A procedure is a command sequence stored with REGISTER and run with CALL.
+// Its arguments $1, $2 and so on are replaced by CALL's arguments.
+type procedure struct {
+	commands [][]string
+	// numArgs is the highest placeholder used, which is how many arguments
+	// CALL must pass.
+	numArgs int
+}
+
+// parseProcedure parses src as commands separated by semicolons, each quoted
+// like an inline command line. Semicolons always separate commands, even
+// inside quotes.
+func parseProcedure(src string) (*procedure, error) {
+	p := &procedure{}
+	for _, line := range strings.Split(src, ";") {
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		info, ok := commandTable[strings.ToUpper(args[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown command '%s'", args[0])
+		}
+		if info.noScript {
+			return nil, fmt.Errorf("'%s' can't be used in a procedure", args[0])
+		}
+		for _, arg := range args[1:] {
+			if n, ok := placeholder(arg); ok && n > p.numArgs {
+				p.numArgs = n
+			}
+		}
+		p.commands = append(p.commands, args)
+	}
+	if len(p.commands) == 0 {
+		return nil, errors.New("no commands")
+	}
+	return p, nil
+}
+
+// placeholder reports whether arg is a placeholder like $1 and returns its
+// 1-based index.
+func placeholder(arg string) (int, bool) {
+	if len(arg) < 2 || arg[0] != '$' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(arg[1:])
+	if err != nil || n < 1 || arg[1] == '+' {
+		return 0, false
+	}
+	return n, true
+}
+
+// run executes the procedure's commands with placeholders replaced by args
+// and writes the reply of the last one to w. It stops at the first error,
+// which becomes the reply instead.
+func (p *procedure) run(w io.Writer, mr *MiniRedis, args []string) {
+	var reply bytes.Buffer
+	for _, command := range p.commands {
+		reply.Reset()
+		cmdArgs := make([]string, len(command))
+		for i, arg := range command {
+			if n, ok := placeholder(arg); ok {
+				arg = args[n-1]
+			}
+			cmdArgs[i] = arg
+		}
+		execCommand(&reply, mr, nil, cmdArgs)
+		if isErrorReply(reply.String()) {
+			break
+		}
+	}
+	_, _ = w.Write(reply.Bytes())
 }
@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run executes one command against mr the way a script would, without a
+// client, and returns its reply.
+func run(mr *MiniRedis, args ...string) string {
+	var reply bytes.Buffer
+	execCommand(&reply, mr, nil, args)
+	return reply.String()
+}
+
+func TestTTLRoundsToNearestSecond(t *testing.T) {
+	mr := NewMiniRedis()
+	if got := run(mr, "SET", "k", "v", "EX", "10"); got != "OK\n" {
+		t.Fatalf("SET k v EX 10 = %q, want OK", got)
+	}
+	if got := run(mr, "TTL", "k"); got != "10\n" {
+		t.Errorf("TTL right after SET EX 10 = %q, want 10", got)
+	}
+
+	tests := []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{9600 * time.Millisecond, 10},
+		{9400 * time.Millisecond, 9},
+		{600 * time.Millisecond, 1},
+		{300 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		mr.Set("k", "v", &tt.ttl)
+		if got, _ := mr.TTL("k"); got != tt.want {
+			t.Errorf("TTL of a key set to expire in %s = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestTTLJitterBounds(t *testing.T) {
+	for _, jitter := range []float64{0.25, 1} {
+		mr := NewMiniRedis()
+		mr.ttlJitter = jitter
+		mr.SetRandSource(mathrand.NewSource(1))
+		ttl := 100 * time.Second
+		lo, hi := int64(100*(1-jitter)), int64(100*(1+jitter))
+		minTTL, maxTTL := hi, lo
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			mr.Set(key, "v", &ttl)
+			got, _ := mr.TTL(key)
+			if got == -1 {
+				t.Fatalf("jitter %v: key %s was stored without an expiry", jitter, key)
+			}
+			if got < lo || got > hi {
+				t.Errorf("jitter %v: TTL %d is outside [%d, %d]", jitter, got, lo, hi)
+			}
+			minTTL, maxTTL = min(minTTL, got), max(maxTTL, got)
+		}
+		// With 1000 draws the TTLs should spread over most of the range.
+		if spread := hi - lo; maxTTL-minTTL < spread*3/4 {
+			t.Errorf("jitter %v: TTLs ranged over [%d, %d], want most of [%d, %d]", jitter, minTTL, maxTTL, lo, hi)
+		}
+	}
+}
+
+func TestTTLJitterIsRepeatable(t *testing.T) {
+	expiries := func() []time.Duration {
+		mr := NewMiniRedis()
+		mr.ttlJitter = 0.5
+		mr.SetRandSource(mathrand.NewSource(42))
+		ttl := time.Hour
+		var offsets []time.Duration
+		for i := 0; i < 10; i++ {
+			before := time.Now()
+			mr.Set("k", "v", &ttl)
+			after := time.Now()
+			v, _ := mr.Object("k")
+			// Round away the time Set itself took.
+			offsets = append(offsets, v.expiry.Sub(before.Add(after.Sub(before)/2)).Round(time.Second))
+		}
+		return offsets
+	}
+	first, second := expiries(), expiries()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("with the same seed, expiry %d was %s then %s", i, first[i], second[i])
+		}
+	}
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	mr := NewMiniRedis()
+	run(mr, "SET", "k", "v1", "EX", "100")
+	if got := run(mr, "SET", "k", "v2", "KEEPTTL"); got != "OK\n" {
+		t.Fatalf("SET KEEPTTL = %q, want OK", got)
+	}
+	if got := run(mr, "GET", "k"); got != "$v2\n" {
+		t.Errorf("GET after SET KEEPTTL = %q, want $v2", got)
+	}
+	if got := run(mr, "TTL", "k"); got != "100\n" {
+		t.Errorf("TTL after SET KEEPTTL = %q, want 100", got)
+	}
+
+	run(mr, "SET", "k", "v3")
+	if got := run(mr, "TTL", "k"); got != "-1\n" {
+		t.Errorf("TTL after a plain SET = %q, want -1", got)
+	}
+
+	run(mr, "SET", "new", "v", "KEEPTTL")
+	if got := run(mr, "TTL", "new"); got != "-1\n" {
+		t.Errorf("TTL of a key created with KEEPTTL = %q, want -1", got)
+	}
+}
+
+func TestListenIPv6AndSecondAddress(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is unavailable: %v", err)
+	} else {
+		_ = l.Close()
+	}
+	listeners, err := listen("[::1]:0, 127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+	mr := NewMiniRedis()
+	for _, listener := range listeners {
+		go serve(listener, mr, nil)
+	}
+	defer closeListeners(listeners)
+
+	for i, listener := range listeners {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		roundTrip := func(cmd string) string {
+			if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			reply, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", listener.Addr(), err)
+			}
+			return reply
+		}
+		key := "k" + strconv.Itoa(i)
+		if got := roundTrip("SET " + key + " " + listener.Addr().String()); got != "OK\n" {
+			t.Errorf("SET on %s = %q, want OK", listener.Addr(), got)
+		}
+		if got := roundTrip("GET " + key); got != "$"+listener.Addr().String()+"\n" {
+			t.Errorf("GET on %s = %q", listener.Addr(), got)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestListenClosesListenersOnFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = taken.Close()
+	}()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	_ = free.Close()
+
+	if _, err := listen(freeAddr+","+taken.Addr().String(), ""); err == nil {
+		t.Fatal("listen succeeded on an address already in use")
+	}
+	// The listener opened on freeAddr before the failure must be closed.
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("%s is still in use after listen failed: %v", freeAddr, err)
+	}
+	_ = l.Close()
+}
+
+func TestReplOffsetCountsOnlyEffectiveWrites(t *testing.T) {
+	mr := NewMiniRedis()
+	offset := func() int64 {
+		_, o := mr.Replication()
+		return o
+	}
+
+	noops := [][]string{
+		{"SET", "k", "v", "EX"},
+		{"SET", "k", "v", "EX", "0"},
+		{"MEXPIRE", "-1", "k"},
+		{"MEXPIRE", "10", "missing"},
+		{"CAS", "missing", "a", "b"},
+		{"DEL", "missing"},
+		{"INCRBYFLOAT", "k", "nan"},
+	}
+	for _, args := range noops {
+		run(mr, args...)
+		if got := offset(); got != 0 {
+			t.Fatalf("offset after %v = %d, want 0", args, got)
+		}
+	}
+
+	// *3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n
+	run(mr, "SET", "k", "v")
+	if got := offset(); got != 27 {
+		t.Fatalf("offset after SET k v = %d, want 27", got)
+	}
+	run(mr, "CAS", "k", "other", "w")
+	run(mr, "DEL", "k", "missing")
+	// *3\r\n$3\r\nDEL\r\n$1\r\nk\r\n$7\r\nmissing\r\n
+	if got := offset(); got != 27+33 {
+		t.Errorf("offset after a failed CAS and a DEL = %d, want %d", got, 27+33)
+	}
+
+	// A script propagates the writes it makes, not the EVAL itself.
+	run(mr, "EVAL", "redis.call('SET', 'k', 'v')", "0")
+	if got := offset(); got != 27+33+27 {
+		t.Errorf("offset after EVAL of a SET = %d, want %d", got, 27+33+27)
+	}
+}
+
+// scanAll runs a full SCAN with the given COUNT, calling mutate between
+// calls, and returns how many times each key was returned.
+func scanAll(t *testing.T, mr *MiniRedis, count int, mutate func(call int)) map[string]int {
+	t.Helper()
+	seen := map[string]int{}
+	var cursor uint64
+	for call := 0; ; call++ {
+		if call > 100000 {
+			t.Fatal("SCAN never returned cursor 0")
+		}
+		next, keys := mr.Scan(cursor, "", count)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if next == 0 {
+			return seen
+		}
+		if next <= cursor {
+			t.Fatalf("SCAN cursor went from %d to %d", cursor, next)
+		}
+		cursor = next
+		mutate(call)
+	}
+}
+
+func TestScanReturnsStableKeysOnceWhileMutating(t *testing.T) {
+	mr := NewMiniRedis()
+	rnd := mathrand.New(mathrand.NewSource(1))
+	const stable, doomed = 500, 3000
+	for i := 0; i < stable; i++ {
+		mr.Set("stable:"+strconv.Itoa(i), "v", nil)
+	}
+	// Interleave keys that get deleted partway through with the stable
+	// ones, and delete enough of them to compact the scan order.
+	for i := 0; i < doomed; i++ {
+		mr.Set("doomed:"+strconv.Itoa(i), "v", nil)
+		if i%6 == 0 {
+			mr.Set("stable:"+strconv.Itoa(stable+i), "v", nil)
+		}
+	}
+	stableKeys := map[string]bool{}
+	for _, info := range mr.KeysInfo("stable:*", 0) {
+		stableKeys[info.Key] = true
+	}
+
+	created := 0
+	seen := scanAll(t, mr, 7, func(call int) {
+		// Once SCAN is partway through the doomed keys, delete them all,
+		// which compacts the scan order under the cursor.
+		if call == 100 {
+			for i := 0; i < doomed; i++ {
+				mr.Delete("doomed:" + strconv.Itoa(i))
+			}
+		}
+		mr.Set("new:"+strconv.Itoa(created), "v", nil)
+		created++
+		// Overwriting a key, with or without the same value, or giving it a
+		// TTL mustn't move it in the scan order.
+		key := "stable:" + strconv.Itoa(rnd.Intn(stable))
+		mr.Set(key, "overwritten", nil)
+		mr.MExpire([]string{key}, time.Hour)
+		mr.Get(key)
+	})
+
+	if total := stable + doomed + doomed/6 + created; len(mr.scanOrder) >= total {
+		t.Fatalf("the scan order wasn't compacted: %d entries for %d keys ever created", len(mr.scanOrder), total)
+	}
+	for key := range stableKeys {
+		if n := seen[key]; n != 1 {
+			t.Errorf("key %s present throughout the scan was returned %d times", key, n)
+		}
+	}
+	for key, n := range seen {
+		if n > 1 {
+			t.Errorf("key %s was returned %d times", key, n)
+		}
+	}
+}
+
+func TestScanKeyRecreatedDuringScan(t *testing.T) {
+	mr := NewMiniRedis()
+	for i := 0; i < 100; i++ {
+		mr.Set(strconv.Itoa(i), "v", nil)
+	}
+	// "0" comes first, so once SCAN is past it, recreating it puts it at
+	// the end, where it is returned again as a new key. That's allowed,
+	// but every other key must still come back exactly once.
+	seen := scanAll(t, mr, 10, func(call int) {
+		if call == 0 {
+			mr.Delete("0")
+			mr.Set("0", "again", nil)
+		}
+	})
+	for i := 1; i < 100; i++ {
+		if n := seen[strconv.Itoa(i)]; n != 1 {
+			t.Errorf("key %d was returned %d times, want 1", i, n)
+		}
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	mr := NewMiniRedis()
+	for i := 0; i < 20; i++ {
+		mr.Set(strconv.Itoa(i), "v", nil)
+	}
+	next, keys := mr.Scan(0, "", math.MaxInt)
+	if next != 0 || len(keys) != 20 {
+		t.Errorf("Scan with COUNT math.MaxInt = %d, %d keys; want 0, 20 keys", next, len(keys))
+	}
+	next, keys = mr.Scan(5, "", math.MaxInt)
+	if next != 0 || len(keys) != 16 {
+		t.Errorf("Scan from cursor 5 with COUNT math.MaxInt = %d, %d keys; want 0, 16 keys", next, len(keys))
+	}
+	reply := run(mr, "SCAN", "0", "COUNT", strconv.Itoa(math.MaxInt))
+	if want := "*2\n$0\n*20\n"; len(reply) < len(want) || reply[:len(want)] != want {
+		t.Errorf("SCAN 0 COUNT %d = %q, want it to start with %q", math.MaxInt, reply, want)
+	}
+}
+
+// evictionTestValue makes every "kNN" key take 3+100+entryOverhead bytes.
+var evictionTestValue = strings.Repeat("x", 100)
+
+const evictionTestKeySize = 3 + 100 + entryOverhead
+
+// newEvictionTest returns a MiniRedis limited to maxKeys "kNN" keys under
+// policy, holding keys k00 up to but not including k<n>.
+func newEvictionTest(t *testing.T, policy string, maxKeys, n int) *MiniRedis {
+	t.Helper()
+	mr := NewMiniRedis()
+	mr.SetRandSource(mathrand.NewSource(1))
+	mr.maxMemory = int64(maxKeys * evictionTestKeySize)
+	mr.evictionPolicy = policy
+	for i := 0; i < n; i++ {
+		if got := run(mr, "SET", evictionKey(i), evictionTestValue); got != "OK\n" {
+			t.Fatalf("SET %s = %q, want OK", evictionKey(i), got)
+		}
+	}
+	return mr
+}
+
+func evictionKey(i int) string {
+	return fmt.Sprintf("k%02d", i)
+}
+
+// missingKeys returns which of the keys k00 up to k<n> are gone.
+func missingKeys(mr *MiniRedis, n int) []string {
+	var missing []string
+	for i := 0; i < n; i++ {
+		if _, ok := mr.Object(evictionKey(i)); !ok {
+			missing = append(missing, evictionKey(i))
+		}
+	}
+	return missing
+}
+
+func TestEvictionNoEviction(t *testing.T) {
+	// The limit is only enforced before a write, so the 11th key fits and
+	// the 12th is refused.
+	mr := newEvictionTest(t, "noeviction", 10, 11)
+	if got := run(mr, "SET", "k11", "v"); got != errorReply(errOOM) {
+		t.Errorf("SET over maxmemory = %q, want %q", got, errorReply(errOOM))
+	}
+	if got := run(mr, "GET", "k00"); got != "$"+evictionTestValue+"\n" {
+		t.Errorf("GET over maxmemory = %q, want the value", got)
+	}
+	run(mr, "DEL", "k10")
+	if got := run(mr, "SET", "k11", "v"); got != "OK\n" {
+		t.Errorf("SET after DEL brought memory under maxmemory = %q, want OK", got)
+	}
+	if missing := missingKeys(mr, 10); len(missing) > 0 {
+		t.Errorf("noeviction removed %v", missing)
+	}
+	if stats := mr.Stats(); stats.EvictedKeys != 0 {
+		t.Errorf("evicted %d keys, want 0", stats.EvictedKeys)
+	}
+}
+
+func TestEvictionAllKeysLRU(t *testing.T) {
+	mr := newEvictionTest(t, "allkeys-lru", 20, 20)
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		run(mr, "GET", evictionKey(i))
+	}
+	// Each SET after the first evicts one key to make room.
+	for i := 20; i < 25; i++ {
+		run(mr, "SET", evictionKey(i), evictionTestValue)
+	}
+
+	missing := missingKeys(mr, 25)
+	if len(missing) != 4 {
+		t.Fatalf("evicted %v, want 4 keys", missing)
+	}
+	for _, key := range missing {
+		if key < "k05" || key >= "k20" {
+			t.Errorf("evicted %s, want only keys that weren't used since k00-k19 were set", key)
+		}
+	}
+	if stats := mr.Stats(); stats.EvictedKeys != 4 {
+		t.Errorf("EvictedKeys = %d, want 4", stats.EvictedKeys)
+	}
+	if got := run(mr, "MEMORY", "STATS"); !strings.Contains(got, "$evicted.keys\n$4\n") {
+		t.Errorf("MEMORY STATS = %q, want evicted.keys 4", got)
+	}
+}
+
+func TestEvictionAllKeysRandom(t *testing.T) {
+	evict := func() []string {
+		mr := newEvictionTest(t, "allkeys-random", 20, 30)
+		if stats := mr.Stats(); stats.EvictedKeys != 9 || stats.UsedMemory != 21*evictionTestKeySize {
+			t.Errorf("EvictedKeys = %d and UsedMemory = %d, want 9 and %d", stats.EvictedKeys, stats.UsedMemory, 21*evictionTestKeySize)
+		}
+		return missingKeys(mr, 30)
+	}
+	first := evict()
+	if len(first) != 9 {
+		t.Fatalf("evicted %v, want 9 keys", first)
+	}
+	if second := evict(); !slices.Equal(first, second) {
+		t.Errorf("with the same seed, evicted %v then %v", first, second)
+	}
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	// k00-k09 don't expire, and k10-k29 expire in order, k10 first.
+	mr := newEvictionTest(t, "volatile-ttl", 30, 10)
+	for i := 10; i < 30; i++ {
+		run(mr, "SET", evictionKey(i), evictionTestValue, "EX", strconv.Itoa(100*i))
+	}
+	for i := 30; i < 35; i++ {
+		run(mr, "SET", evictionKey(i), evictionTestValue)
+	}
+
+	missing := missingKeys(mr, 35)
+	if len(missing) != 4 {
+		t.Fatalf("evicted %v, want 4 keys", missing)
+	}
+	// Eviction compares a sample of keys, so the keys evicted are among
+	// the nearest expiries rather than exactly the nearest.
+	for _, key := range missing {
+		if key < "k10" || key >= "k25" {
+			t.Errorf("evicted %s, want only keys from the nearest three quarters of the expiries, k10-k24", key)
+		}
+	}
+	if stats := mr.Stats(); stats.EvictedKeys != 4 {
+		t.Errorf("EvictedKeys = %d, want 4", stats.EvictedKeys)
+	}
+}
+
+func TestEvictionVolatileTTLWithoutVolatileKeys(t *testing.T) {
+	mr := newEvictionTest(t, "volatile-ttl", 20, 19)
+	run(mr, "SET", "k19", evictionTestValue, "EX", "1000")
+	run(mr, "SET", "k20", evictionTestValue)
+
+	// Sampling can miss the only key with a TTL, but it's still found.
+	run(mr, "SET", "k21", evictionTestValue)
+	if missing := missingKeys(mr, 22); !slices.Equal(missing, []string{"k19"}) {
+		t.Errorf("evicted %v, want the only key with a TTL, k19", missing)
+	}
+	// Only keys with a TTL can be evicted, and none are left.
+	if got := run(mr, "SET", "k22", evictionTestValue); got != errorReply(errOOM) {
+		t.Errorf("SET with no volatile keys left = %q, want %q", got, errorReply(errOOM))
+	}
+	if stats := mr.Stats(); stats.EvictedKeys != 1 {
+		t.Errorf("EvictedKeys = %d, want 1", stats.EvictedKeys)
+	}
+}
+
+func TestEvictionDoesNotCountExpiredKeys(t *testing.T) {
+	mr := newEvictionTest(t, "volatile-ttl", 20, 0)
+	mr.SetActiveExpire(false)
+	ttl := time.Millisecond
+	for i := 0; i < 5; i++ {
+		mr.Set(evictionKey(i), evictionTestValue, &ttl)
+	}
+	for i := 5; i < 20; i++ {
+		run(mr, "SET", evictionKey(i), evictionTestValue)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The only keys with a TTL have expired but are still stored, so
+	// making room for k21 and k22 removes two of them as expired keys, not
+	// evicted ones.
+	for i := 20; i < 23; i++ {
+		run(mr, "SET", evictionKey(i), evictionTestValue)
+	}
+	stats := mr.Stats()
+	if stats.EvictedKeys != 0 || stats.ExpiredKeys != 2 {
+		t.Errorf("EvictedKeys = %d and ExpiredKeys = %d, want 0 and 2", stats.EvictedKeys, stats.ExpiredKeys)
+	}
+	if missing := missingKeys(mr, 23); len(missing) != 5 || missing[4] != "k04" {
+		t.Errorf("missing %v, want only the expired keys k00-k04", missing)
+	}
+}
+
+func TestParseExpireTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		unit time.Duration
+		want time.Duration
+		err  error
+	}{
+		{"10", time.Second, 10 * time.Second, nil},
+		{"10", time.Millisecond, 10 * time.Millisecond, nil},
+		{"1", time.Millisecond, time.Millisecond, nil},
+		{"9223372036", time.Second, 9223372036 * time.Second, nil},
+		{"9223372036854", time.Millisecond, 9223372036854 * time.Millisecond, nil},
+		{"0", time.Second, 0, errInvalidExpireTime},
+		{"0", time.Millisecond, 0, errInvalidExpireTime},
+		{"-1", time.Second, 0, errInvalidExpireTime},
+		{"-9223372036854775808", time.Millisecond, 0, errInvalidExpireTime},
+		{"1.5", time.Second, 0, errInvalidExpireTime},
+		{"1e3", time.Second, 0, errInvalidExpireTime},
+		{"10s", time.Second, 0, errInvalidExpireTime},
+		{"", time.Second, 0, errInvalidExpireTime},
+		{" 10", time.Second, 0, errInvalidExpireTime},
+		{"abc", time.Second, 0, errInvalidExpireTime},
+		// Too large for a time.Duration, or for an int64 at all.
+		{"9223372037", time.Second, 0, errInvalidExpireTime},
+		{"9223372036855", time.Millisecond, 0, errInvalidExpireTime},
+		{"9223372036854775808", time.Millisecond, 0, errInvalidExpireTime},
+	}
+	for _, tt := range tests {
+		got, err := parseExpireTime(tt.s, tt.unit)
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseExpireTime(%q, %s) = %s, %v; want %s, %v", tt.s, tt.unit, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseSetOptions(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour)
+	exat := strconv.FormatInt(future.Unix(), 10)
+	pxat := strconv.FormatInt(future.UnixMilli(), 10)
+	earlier := now.Add(-time.Hour)
+	past := strconv.FormatInt(earlier.Unix(), 10)
+
+	tests := []struct {
+		args []string
+		// want is the expected TTL, or -1 for none; TTLs from EXAT and PXAT
+		// are checked to the second.
+		want    time.Duration
+		keepTTL bool
+		err     error
+	}{
+		{args: nil, want: -1},
+		{args: []string{"EX", "10"}, want: 10 * time.Second},
+		{args: []string{"ex", "10"}, want: 10 * time.Second},
+		{args: []string{"PX", "1500"}, want: 1500 * time.Millisecond},
+		{args: []string{"EXAT", exat}, want: time.Until(time.Unix(future.Unix(), 0))},
+		{args: []string{"PXAT", pxat}, want: time.Until(time.UnixMilli(future.UnixMilli()))},
+		{args: []string{"EXAT", past}, want: time.Until(time.Unix(earlier.Unix(), 0))},
+		{args: []string{"KEEPTTL"}, want: -1, keepTTL: true},
+		{args: []string{"keepttl"}, want: -1, keepTTL: true},
+
+		{args: []string{"EX", "0"}, err: errInvalidExpireTime},
+		{args: []string{"EX", "-1"}, err: errInvalidExpireTime},
+		{args: []string{"PX", "-100"}, err: errInvalidExpireTime},
+		{args: []string{"EX", "1.5"}, err: errInvalidExpireTime},
+		{args: []string{"PXAT", "0"}, err: errInvalidExpireTime},
+		{args: []string{"EX", "9223372037"}, err: errInvalidExpireTime},
+		{args: []string{"EXAT", "9223372037"}, err: errInvalidExpireTime},
+
+		{args: []string{"EX"}, err: errSyntax},
+		{args: []string{"EX", "10", "EX", "10"}, err: errSyntax},
+		{args: []string{"EX", "10", "PX", "10"}, err: errSyntax},
+		{args: []string{"PX", "10", "EXAT", exat}, err: errSyntax},
+		{args: []string{"EX", "10", "KEEPTTL"}, err: errSyntax},
+		{args: []string{"KEEPTTL", "EX", "10"}, err: errSyntax},
+		{args: []string{"KEEPTTL", "PXAT", pxat}, err: errSyntax},
+		{args: []string{"KEEPTTL", "KEEPTTL"}, err: errSyntax},
+		{args: []string{"NX"}, err: errSyntax},
+		{args: []string{"10"}, err: errSyntax},
+	}
+	for _, tt := range tests {
+		opts, err := parseSetOptions(tt.args)
+		if err != tt.err {
+			t.Errorf("parseSetOptions(%q) error = %v, want %v", tt.args, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if opts.keepTTL != tt.keepTTL {
+			t.Errorf("parseSetOptions(%q).keepTTL = %v, want %v", tt.args, opts.keepTTL, tt.keepTTL)
+		}
+		got := time.Duration(-1)
+		if opts.expires != nil {
+			got = *opts.expires
+		}
+		if got.Round(time.Second) != tt.want.Round(time.Second) {
+			t.Errorf("parseSetOptions(%q) TTL = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestTTLCommandsRejectTheSameInputs(t *testing.T) {
+	mr := NewMiniRedis()
+	run(mr, "SET", "k", "v")
+	want := errorReply(errInvalidExpireTime)
+	for _, ttl := range []string{"0", "-1", "1.5", "abc", "9223372037"} {
+		for _, args := range [][]string{
+			{"SET", "k", "v", "EX", ttl},
+			{"SET", "k", "v", "EXAT", ttl},
+			{"MEXPIRE", ttl, "k"},
+		} {
+			if got := run(mr, args...); got != want {
+				t.Errorf("%q = %q, want %q", args, got, want)
+			}
+		}
+	}
+	if got := run(mr, "TTL", "k"); got != "-1\n" {
+		t.Errorf("TTL after only invalid expiries = %q, want -1", got)
+	}
+}
+
+func TestSetExpiryOptions(t *testing.T) {
+	mr := NewMiniRedis()
+	later := time.Now().Add(100 * time.Second).Unix()
+	tests := []struct {
+		args []string
+		// The TTL must be between lo and hi. EXAT and PXAT name whole
+		// seconds, so their TTLs depend on the current fraction of one.
+		lo, hi int64
+	}{
+		{[]string{"EX", "100"}, 100, 100},
+		{[]string{"PX", "1600"}, 2, 2},
+		{[]string{"PX", "1300"}, 1, 1},
+		{[]string{"EXAT", strconv.FormatInt(later, 10)}, 99, 100},
+		{[]string{"PXAT", strconv.FormatInt(later*1000, 10)}, 99, 100},
+	}
+	for _, tt := range tests {
+		args := append([]string{"SET", "k", "v"}, tt.args...)
+		if got := run(mr, args...); got != "OK\n" {
+			t.Fatalf("%q = %q, want OK", args, got)
+		}
+		if got, _ := mr.TTL("k"); got < tt.lo || got > tt.hi {
+			t.Errorf("TTL after %q = %d, want %d to %d", args, got, tt.lo, tt.hi)
+		}
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if got := run(mr, "SET", "k", "v", "PXAT", past); got != "OK\n" {
+		t.Fatalf("SET with a PXAT in the past = %q, want OK", got)
+	}
+	if got := run(mr, "GET", "k"); got != "$-1\n" {
+		t.Errorf("GET after SET with a PXAT in the past = %q, want nil", got)
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+
+		{"*", "", true},
+		{"*", "anything", true},
+		{"**", "x", true},
+		{"a*", "a", true},
+		{"a*", "abc", true},
+		{"a*", "bac", false},
+		{"*c", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"*a", "", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+
+		{"?", "a", true},
+		{"?", "", false},
+		{"??", "a", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[abc]", "", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"[a-c]", "b", true},
+		{"[a-c]", "d", false},
+		{"[c-a]", "b", true},
+		{"[a-cx-z]", "y", true},
+		{"[a-cx-z]", "m", false},
+		{"[^abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[^a-c]", "d", true},
+		{"[^a-c]", "b", false},
+		{"[^x]", "", false},
+		{"[abc", "a", true},
+		{"[abc", "ab", false},
+
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`\?`, "?", true},
+		{`\?`, "a", false},
+		{`\[a]`, "[a]", true},
+		{`\[a]`, "a", false},
+		{`\\`, `\`, true},
+		{`a\`, `a\`, true},
+		{`[\]]`, "]", true},
+		{`[\^a]`, "^", true},
+		{`[\-]`, "-", true},
+		{`*\*`, "a*", true},
+		{`*\*`, "ab", false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("stringMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+
+	// Backtracking into every * took exponential time on patterns like
+	// these, with KEYSINFO and SCAN holding the keyspace lock throughout.
+	start := time.Now()
+	for _, tt := range []struct{ pattern, s string }{
+		{strings.Repeat("*a", 8) + "b", strings.Repeat("a", 200)},
+		{strings.Repeat("*a", 100) + "b", strings.Repeat("a", 10000)},
+		{strings.Repeat("*[a-z]", 100) + "b", strings.Repeat("a", 10000)},
+	} {
+		if stringMatch(tt.pattern, tt.s) {
+			t.Errorf("stringMatch(%q, %d bytes of a) = true, want false", tt.pattern, len(tt.s))
+		}
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("pathological patterns took %s to match, want under a second", took)
+	}
+	if !stringMatch(strings.Repeat("*a", 100), strings.Repeat("a", 10000)) {
+		t.Errorf("stringMatch(%q, 10000 bytes of a) = false, want true", strings.Repeat("*a", 100))
+	}
+
+	mr := NewMiniRedis()
+	if got := run(mr, "DEBUG", "STRINGMATCH-LEN", "h[ae]llo", "hello"); got != ":1\n" {
+		t.Errorf("DEBUG STRINGMATCH-LEN of a match = %q, want :1", got)
+	}
+	if got := run(mr, "DEBUG", "STRINGMATCH-LEN", "h[ae]llo", "hillo"); got != ":0\n" {
+		t.Errorf("DEBUG STRINGMATCH-LEN of a mismatch = %q, want :0", got)
+	}
+}
+
+func TestSetIntEncoding(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"123", "int"},
+		{"0", "int"},
+		{"-5", "int"},
+		{"9223372036854775807", "int"},
+		{"-9223372036854775808", "int"},
+		{"123abc", "embstr"},
+		{"0123", "embstr"},
+		{"+1", "embstr"},
+		{"-0", "embstr"},
+		{" 1", "embstr"},
+		{"1.0", "embstr"},
+		{"9223372036854775808", "embstr"},
+		{"", "embstr"},
+		{strings.Repeat("x", 44), "embstr"},
+		{strings.Repeat("x", 45), "raw"},
+		{strings.Repeat("1", 45), "raw"},
+	}
+	mr := NewMiniRedis()
+	for _, tt := range tests {
+		run(mr, "SET", "k", tt.value)
+		if got := run(mr, "OBJECT", "ENCODING", "k"); got != "$"+tt.want+"\n" {
+			t.Errorf("OBJECT ENCODING after SET k %q = %q, want %s", tt.value, got, tt.want)
+		}
+		if got := run(mr, "GET", "k"); got != "$"+tt.value+"\n" {
+			t.Errorf("GET after SET k %q = %q", tt.value, got)
+		}
+	}
+
+	run(mr, "SET", "k", "123")
+	if v, _ := mr.Object("k"); v.intValue != 123 {
+		t.Errorf("intValue after SET k 123 = %d, want 123", v.intValue)
+	}
+	// Overwriting with a string must drop the integer.
+	run(mr, "SET", "k", "abc")
+	if v, _ := mr.Object("k"); v.intEncoded || v.intValue != 0 {
+		t.Errorf("after SET k abc, intEncoded = %v and intValue = %d, want false and 0", v.intEncoded, v.intValue)
+	}
+	run(mr, "SET", "k", "1.5")
+	run(mr, "INCRBYFLOAT", "k", "1.5")
+	if got := run(mr, "OBJECT", "ENCODING", "k"); got != "$int\n" {
+		t.Errorf("OBJECT ENCODING after INCRBYFLOAT to 3 = %q, want int", got)
+	}
+}
+
+func TestSplitArgsRejectsLineBreaks(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  error
+	}{
+		{`SET k "a\nb"`, nil, errNewlineInArg},
+		{`SET k "a\r"`, nil, errNewlineInArg},
+		{`SET k "\x0a"`, nil, errNewlineInArg},
+		{`SET k "\x0D"`, nil, errNewlineInArg},
+		{"SET k \"a\rb\"", nil, errNewlineInArg},
+		{`SET k "a\tb"`, []string{"SET", "k", "a\tb"}, nil},
+		{`SET k 'a\nb'`, []string{"SET", "k", `a\nb`}, nil},
+		{"SET k v\r\n", []string{"SET", "k", "v"}, nil},
+		{"SET k \"v\"\r\n", []string{"SET", "k", "v"}, nil},
+		{"SET k \"v\r\n", nil, errUnbalancedQuotes},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != tt.err || !slices.Equal(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v; want %q, %v", tt.line, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLineBreakInArgumentClosesOnlyThatConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := NewMiniRedis()
+	go serve(listener, mr, nil)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	type conn struct {
+		net.Conn
+		*bufio.Reader
+	}
+	dial := func() conn {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn{c, bufio.NewReader(c)}
+	}
+	roundTrip := func(c conn, cmd string) string {
+		if _, err := c.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := c.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", cmd, err)
+		}
+		return reply
+	}
+
+	bad, other := dial(), dial()
+	defer func() {
+		_ = bad.Close()
+		_ = other.Close()
+	}()
+	if got := roundTrip(other, "SET before v"); got != "OK\n" {
+		t.Fatalf("SET = %q, want OK", got)
+	}
+	if got := roundTrip(bad, `SET k "a\nb"`); got != errorReply(errNewlineInArg) {
+		t.Errorf("SET with a LF in the value = %q, want %q", got, errorReply(errNewlineInArg))
+	}
+	if _, err := bad.ReadString('\n'); err != io.EOF {
+		t.Errorf("after a protocol error, read = %v, want EOF", err)
+	}
+
+	// Replies on other connections, old and new, stay in step with their
+	// commands, and nothing was stored.
+	for _, c := range []conn{other, dial()} {
+		if got := roundTrip(c, "GET k"); got != "$-1\n" {
+			t.Errorf("GET k = %q, want nil", got)
+		}
+		if got := roundTrip(c, "GET before"); got != "$v\n" {
+			t.Errorf("GET before = %q, want $v", got)
+		}
+		if got := roundTrip(c, `SET k2 "a\tb"`); got != "OK\n" {
+			t.Errorf("SET with a tab = %q, want OK", got)
+		}
+	}
+}
+
+func TestScriptsRejectLineBreaks(t *testing.T) {
+	mr := NewMiniRedis()
+	if got := run(mr, "EVAL", `return redis.call('SET', 'k', "a\nb")`, "0"); !strings.HasPrefix(got, "-ERR Error compiling script") {
+		t.Errorf("EVAL with a LF in a string = %q, want a compile error", got)
+	}
+	if got := run(mr, "EVAL", `return 'a\rb'`, "0"); !strings.HasPrefix(got, "-ERR Error compiling script") {
+		t.Errorf("EVAL returning a CR = %q, want a compile error", got)
+	}
+	if got := run(mr, "REGISTER", "p", `SET k "a\nb"`); !strings.HasPrefix(got, "-ERR Error compiling procedure") {
+		t.Errorf("REGISTER with a LF in an argument = %q, want a compile error", got)
+	}
+	if got := run(mr, "CALL", "p"); got != "-ERR No such procedure\n" {
+		t.Errorf("CALL of the rejected procedure = %q, want no such procedure", got)
+	}
+	if got := run(mr, "GET", "k"); got != "$-1\n" {
+		t.Errorf("GET k = %q, want nil", got)
+	}
+}
+
+// newIndexedMiniRedis returns a MiniRedis that expires keys through the
+// expiry index.
+func newIndexedMiniRedis(t *testing.T) *MiniRedis {
+	t.Helper()
+	expiryIndex = true
+	defer func() {
+		expiryIndex = false
+	}()
+	return NewMiniRedis()
+}
+
+// waitForKeys polls, without looking up any key, until mr holds n keys or
+// timeout passes, and returns how long that took.
+func waitForKeys(mr *MiniRedis, n int, timeout time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if mr.Stats().Keys == n {
+			return time.Since(start), true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return time.Since(start), false
+}
+
+func TestExpiryIndexExpiresOnTime(t *testing.T) {
+	mr := newIndexedMiniRedis(t)
+	// The expiry goroutine is asleep until this key's expiry an hour from
+	// now, so the next key must wake it.
+	hour, ttl := time.Hour, 50*time.Millisecond
+	mr.Set("later", "v", &hour)
+	time.Sleep(10 * time.Millisecond)
+	mr.Set("soon", "v", &ttl)
+
+	took, ok := waitForKeys(mr, 1, time.Second)
+	if !ok {
+		t.Fatalf("the key wasn't expired within %s of being set to expire in %s", took, ttl)
+	}
+	if took < ttl-5*time.Millisecond || took > ttl+200*time.Millisecond {
+		t.Errorf("the key was expired after %s, want about %s", took, ttl)
+	}
+	if _, ok := mr.Object("later"); !ok {
+		t.Error("the key expiring in an hour is gone")
+	}
+	if stats := mr.Stats(); stats.ExpiredKeys != 1 {
+		t.Errorf("ExpiredKeys = %d, want 1", stats.ExpiredKeys)
+	}
+}
+
+func TestExpiryIndexIgnoresOverwrittenExpiries(t *testing.T) {
+	mr := newIndexedMiniRedis(t)
+	ttl, hour := 30*time.Millisecond, time.Hour
+	for _, key := range []string{"extended", "persisted", "recreated"} {
+		mr.Set(key, "v", &ttl)
+	}
+	run(mr, "MEXPIRE", "3600", "extended")
+	run(mr, "SET", "persisted", "v")
+	run(mr, "DEL", "recreated")
+	mr.Set("recreated", "v", &hour)
+	// A later expiry shortened to an earlier one is still honoured.
+	mr.Set("shortened", "v", &hour)
+	mr.Set("shortened", "v", &ttl)
+
+	if _, ok := waitForKeys(mr, 3, time.Second); !ok {
+		t.Fatalf("%d keys left, want 3 once shortened expires", mr.Stats().Keys)
+	}
+	// Give the stale entries for the other keys time to come due.
+	time.Sleep(50 * time.Millisecond)
+	for _, key := range []string{"extended", "persisted", "recreated"} {
+		if _, ok := mr.Object(key); !ok {
+			t.Errorf("%s was expired by the entry for its old expiry", key)
+		}
+	}
+	if stats := mr.Stats(); stats.ExpiredKeys != 1 {
+		t.Errorf("ExpiredKeys = %d, want 1", stats.ExpiredKeys)
+	}
+}
+
+func TestExpiryIndexStaysBounded(t *testing.T) {
+	mr := newIndexedMiniRedis(t)
+	heapLen := func() int {
+		mr.mu.Lock()
+		defer mr.mu.Unlock()
+		return mr.expiries.Len()
+	}
+
+	const keys = 10
+	hour := time.Hour
+	for i := 0; i < keys; i++ {
+		mr.Set(strconv.Itoa(i), "v", &hour)
+	}
+	before := heapLen()
+	for i := 0; i < 10000; i++ {
+		mr.Get(strconv.Itoa(i % keys))
+	}
+	if got := heapLen(); got != before {
+		t.Errorf("reads grew the expiry index from %d to %d entries", before, got)
+	}
+
+	// Each rewrite with a new expiry leaves a stale entry until the index
+	// is rebuilt.
+	limit := 2*keys + 1024 + 1
+	for i := 0; i < 10000; i++ {
+		ttl := time.Hour + time.Duration(i)*time.Millisecond
+		mr.Set(strconv.Itoa(i%keys), "v", &ttl)
+		if got := heapLen(); got > limit {
+			t.Fatalf("after %d rewrites the expiry index has %d entries for %d keys, want at most %d", i+1, got, keys, limit)
+		}
+	}
+}